@@ -0,0 +1,404 @@
+package captchouli
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakape/boorufetch"
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+)
+
+const (
+	// Version of the pool archive format
+	archiveVersion = 1
+
+	// Name of the first file of a pool archive describing all images
+	manifestName = "manifest.json"
+
+	// Directory of thumbnail files in pool archives
+	archiveImageDir = "images/"
+)
+
+// Describes all images of a pool archive
+type manifest struct {
+	Version int             `json:"version"`
+	Images  []manifestImage `json:"images"`
+}
+
+// Source image in a pool archive
+type manifestImage struct {
+	MD5    string         `json:"md5"`
+	Rating string         `json:"rating"`
+	Source string         `json:"source"`
+	Tags   []string       `json:"tags"`
+	Crops  []manifestCrop `json:"crops"`
+}
+
+// Thumbnail cropped from a source image in a pool archive. The thumbnail file
+// is stored as archiveImageDir + Hash.
+type manifestCrop struct {
+	Hash    string         `json:"hash"`
+	PHash   string         `json:"phash,omitempty"`
+	Quality common.Quality `json:"quality"`
+}
+
+func encodeManifestImage(img db.Image) manifestImage {
+	m := manifestImage{
+		MD5:    hex.EncodeToString(img.MD5[:]),
+		Rating: img.Rating.String(),
+		Source: strings.ToLower(img.Source.String()),
+		Tags:   img.Tags,
+		Crops:  make([]manifestCrop, len(img.Crops)),
+	}
+	for i, c := range img.Crops {
+		m.Crops[i] = manifestCrop{
+			Hash:    hex.EncodeToString(c.Hash[:]),
+			Quality: c.Quality,
+		}
+		if c.HasPHash {
+			m.Crops[i].PHash = fmt.Sprintf("%016x", c.PHash)
+		}
+	}
+	return m
+}
+
+func (m manifestImage) decode() (img db.Image, err error) {
+	img.MD5, err = common.DecodeMD5(m.MD5)
+	if err != nil {
+		return
+	}
+	img.Tags = m.Tags
+	if len(img.Tags) == 0 {
+		err = Error{fmt.Errorf("image without tags: %s", m.MD5)}
+		return
+	}
+	found := false
+	for _, r := range [...]Rating{Safe, Questionable, Explicit,
+		boorufetch.Sensitive} {
+		if r.String() == m.Rating {
+			img.Rating = r
+			found = true
+			break
+		}
+	}
+	if !found {
+		err = Error{fmt.Errorf("unknown image rating: %s", m.Rating)}
+		return
+	}
+	found = false
+	for _, s := range [...]DataSource{Gelbooru, Danbooru} {
+		if strings.ToLower(s.String()) == m.Source {
+			img.Source = s
+			found = true
+			break
+		}
+	}
+	if !found {
+		err = Error{fmt.Errorf("unknown image source: %s", m.Source)}
+		return
+	}
+	if len(m.Crops) == 0 {
+		err = Error{fmt.Errorf("image without crops: %s", m.MD5)}
+		return
+	}
+
+	img.Crops = make([]db.Crop, len(m.Crops))
+	for i, c := range m.Crops {
+		img.Crops[i].Hash, err = common.DecodeMD5(c.Hash)
+		if err != nil {
+			return
+		}
+		img.Crops[i].Quality = c.Quality
+		if c.PHash != "" {
+			img.Crops[i].PHash, err = strconv.ParseUint(c.PHash, 16, 64)
+			if err != nil {
+				err = Error{fmt.Errorf("invalid perceptual hash: %s", c.PHash)}
+				return
+			}
+			img.Crops[i].HasPHash = true
+		}
+	}
+	return
+}
+
+// Write all pooled images tagged with any of tags, their tags and thumbnails
+// to w as a tar archive. If tags is empty, the entire pool is exported.
+// Returns the number of exported source images. Requires Open to have been
+// called.
+//
+// Use ImportPool to add the images to the pool of another instance, such as
+// one without booru access.
+func ExportPool(w io.Writer, tags []string) (n int, err error) {
+	resolved := make([]string, len(tags))
+	for i, t := range tags {
+		resolved[i], _, err = db.ResolveTagAlias(t)
+		if err != nil {
+			return
+		}
+	}
+	images, err := db.GetImages(resolved)
+	if err != nil {
+		return
+	}
+
+	m := manifest{
+		Version: archiveVersion,
+		Images:  make([]manifestImage, 0, len(images)),
+	}
+	exported := images[:0]
+	for _, img := range images {
+		missing := false
+		for _, c := range img.Crops {
+			_, err = os.Stat(common.ThumbPath(c.Hash))
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return
+				}
+				err = nil
+				missing = true
+				break
+			}
+		}
+		if missing {
+			common.LogWarn("thumbnail missing; skipping image",
+				"md5", hex.EncodeToString(img.MD5[:]))
+			continue
+		}
+		exported = append(exported, img)
+		m.Images = append(m.Images, encodeManifestImage(img))
+	}
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	writeFile := func(name string, data []byte) (err error) {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return
+		}
+		_, err = tw.Write(data)
+		return
+	}
+	err = writeFile(manifestName, buf)
+	if err != nil {
+		return
+	}
+	for _, img := range exported {
+		for _, c := range img.Crops {
+			buf, err = ioutil.ReadFile(common.ThumbPath(c.Hash))
+			if err != nil {
+				return
+			}
+			err = writeFile(archiveImageDir+hex.EncodeToString(c.Hash[:]),
+				buf)
+			if err != nil {
+				return
+			}
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+	n = len(exported)
+	return
+}
+
+// Source image to be imported from a pool archive
+type importedImage struct {
+	db.Image
+	missing int // Number of thumbnails not yet read from the archive
+}
+
+// Add the images of a tar archive written by ExportPool to the pool. Images
+// already in the database, including blacklisted ones, and crops already
+// stored or visually similar to pooled or previously imported images are
+// skipped. Returns the number of imported and skipped source images. Requires
+// Open to have been called.
+func ImportPool(r io.Reader) (imported, skipped int, err error) {
+	tr := tar.NewReader(r)
+	h, err := tr.Next()
+	if err == io.EOF || (err == nil && h.Name != manifestName) {
+		err = Error{errors.New("pool archive must start with " +
+			manifestName)}
+	}
+	if err != nil {
+		return
+	}
+	var m manifest
+	err = json.NewDecoder(tr).Decode(&m)
+	if err != nil {
+		return
+	}
+	if m.Version != archiveVersion {
+		err = Error{fmt.Errorf("unsupported pool archive version: %d",
+			m.Version)}
+		return
+	}
+
+	var (
+		images []*importedImage
+		seen   = make(map[[16]byte]struct{}, len(m.Images))
+		byCrop = make(map[[16]byte]*importedImage)
+
+		// Perceptual hashes of crops accepted from this archive so far
+		accepted []uint64
+	)
+	for _, mi := range m.Images {
+		var img db.Image
+		img, err = mi.decode()
+		if err != nil {
+			return
+		}
+		if _, ok := seen[img.MD5]; ok {
+			skipped++
+			continue
+		}
+		seen[img.MD5] = struct{}{}
+
+		var inDB bool
+		inDB, err = db.IsInDatabase(img.MD5)
+		if err != nil {
+			return
+		}
+		if inDB {
+			skipped++
+			continue
+		}
+
+		crops := img.Crops[:0]
+		for _, c := range img.Crops {
+			var skip bool
+			skip, err = skipImportedCrop(c, byCrop, accepted)
+			if err != nil {
+				return
+			}
+			if !skip {
+				crops = append(crops, c)
+				if c.HasPHash {
+					accepted = append(accepted, c.PHash)
+				}
+			}
+		}
+		if len(crops) == 0 {
+			skipped++
+			continue
+		}
+		img.Crops = crops
+
+		ii := &importedImage{
+			Image:   img,
+			missing: len(crops),
+		}
+		images = append(images, ii)
+		for _, c := range crops {
+			byCrop[c.Hash] = ii
+		}
+	}
+
+	// Remove thumbnails of images not inserted on failure
+	defer func() {
+		if err != nil {
+			for _, ii := range images[imported:] {
+				for _, c := range ii.Crops {
+					os.Remove(common.ThumbPath(c.Hash))
+				}
+			}
+		}
+	}()
+
+	for {
+		h, err = tr.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		dir, name := path.Split(h.Name)
+		if dir != archiveImageDir {
+			continue
+		}
+		var hash [16]byte
+		hash, err = common.DecodeMD5(name)
+		if err != nil {
+			return
+		}
+		ii := byCrop[hash]
+		if ii == nil {
+			continue
+		}
+		delete(byCrop, hash)
+
+		var buf []byte
+		buf, err = ioutil.ReadAll(tr)
+		if err != nil {
+			return
+		}
+		err = writeThumbnail(buf, hash)
+		if err != nil {
+			return
+		}
+		ii.missing--
+	}
+
+	for _, ii := range images {
+		if ii.missing != 0 {
+			err = Error{fmt.Errorf("thumbnail missing from pool archive: %s",
+				hex.EncodeToString(ii.MD5[:]))}
+			return
+		}
+	}
+	for _, ii := range images {
+		err = db.InsertImage(ii.Image)
+		if err != nil {
+			return
+		}
+		imported++
+	}
+	return
+}
+
+// Return, if an archived crop is already stored or claimed by another image of
+// the archive or visually similar to a pooled or accepted crop
+func skipImportedCrop(c db.Crop, claimed map[[16]byte]*importedImage,
+	accepted []uint64,
+) (skip bool, err error) {
+	if _, ok := claimed[c.Hash]; ok {
+		return true, nil
+	}
+	skip, err = db.IsCropInDatabase(c.Hash)
+	if err != nil || skip || !c.HasPHash {
+		return
+	}
+	_, skip, err = db.FindDuplicate(c.PHash)
+	if err != nil || skip {
+		return
+	}
+	for _, p := range accepted {
+		if db.IsDuplicate(p, c.PHash) {
+			return true, nil
+		}
+	}
+	return
+}
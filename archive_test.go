@@ -0,0 +1,335 @@
+package captchouli
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+	"github.com/bakape/captchouli/v2/test_utils"
+)
+
+func assertEqual(t *testing.T, res, std interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(res, std) {
+		t.Fatalf("\nexpected: %#v\ngot:      %#v", std, res)
+	}
+}
+
+// Create an image with random hashes, crops crops and random thumbnails tagged
+// with tags
+func randomImage(t *testing.T, crops int, tags ...string,
+) (img db.Image, thumbs map[[16]byte][]byte) {
+	t.Helper()
+
+	img = db.Image{
+		Rating: Questionable, // Not served by services with default settings
+		Source: Danbooru,
+		Tags:   tags,
+	}
+	_, err := rand.Read(img.MD5[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbs = make(map[[16]byte][]byte)
+	for i := 0; i < crops; i++ {
+		c := db.Crop{
+			Hash: common.CropHash(img.MD5, i),
+			Quality: common.Quality{
+				FaceSize:  100 + i,
+				Sharpness: 50,
+			},
+		}
+		var buf [64]byte
+		_, err = rand.Read(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.PHash = binary.LittleEndian.Uint64(buf[:])
+		c.HasPHash = true
+		thumbs[c.Hash] = buf[:]
+		img.Crops = append(img.Crops, c)
+	}
+	return
+}
+
+// Like randomImage, but also inserts the image and its thumbnails into the
+// pool
+func insertPooled(t *testing.T, crops int, tags ...string,
+) (img db.Image, thumbs map[[16]byte][]byte) {
+	t.Helper()
+
+	img, thumbs = randomImage(t, crops, tags...)
+	for hash, thumb := range thumbs {
+		err := writeThumbnail(thumb, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.InsertImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// Read the manifest and thumbnails of a pool archive
+func readArchive(t *testing.T, r io.Reader,
+) (m manifest, thumbs map[string][]byte) {
+	t.Helper()
+
+	thumbs = make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for i := 0; ; i++ {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if h.Name != manifestName {
+				t.Fatalf("archive does not start with manifest: %s", h.Name)
+			}
+			err = json.Unmarshal(buf, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			thumbs[h.Name] = buf
+		}
+	}
+}
+
+// Write a pool archive of images and thumbs
+func writeArchive(t *testing.T, thumbs map[[16]byte][]byte,
+	images ...db.Image,
+) []byte {
+	t.Helper()
+
+	m := manifest{
+		Version: archiveVersion,
+		Images:  make([]manifestImage, len(images)),
+	}
+	for i, img := range images {
+		m.Images[i] = encodeManifestImage(img)
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	tw := tar.NewWriter(&w)
+	writeFile := func(name string, data []byte) {
+		err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0600,
+			Size: int64(len(data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(manifestName, manifest)
+	for hash, thumb := range thumbs {
+		writeFile(archiveImageDir+hex.EncodeToString(hash[:]), thumb)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Bytes()
+}
+
+func TestExportPool(t *testing.T) {
+	tag := test_utils.RandomTag()
+	a, thumbsA := insertPooled(t, 2, tag, "solo")
+	b, thumbsB := insertPooled(t, 1, tag)
+	insertPooled(t, 1, test_utils.RandomTag())
+
+	var w bytes.Buffer
+	n, err := ExportPool(&w, []string{strings.ToUpper(tag)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected export count: %d", n)
+	}
+
+	m, thumbs := readArchive(t, &w)
+	if m.Version != archiveVersion || len(m.Images) != 2 {
+		t.Fatalf("unexpected manifest: %+v", m)
+	}
+	exported := make(map[string]manifestImage)
+	for _, img := range m.Images {
+		exported[img.MD5] = img
+	}
+	for _, img := range [...]db.Image{a, b} {
+		got, ok := exported[hex.EncodeToString(img.MD5[:])]
+		if !ok {
+			t.Fatalf("image not exported: %x", img.MD5)
+		}
+		decoded, err := got.decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, decoded.Crops, img.Crops)
+		assertEqual(t, decoded.Rating, img.Rating)
+		assertEqual(t, got.Source, "danbooru")
+	}
+	assertEqual(t, exported[hex.EncodeToString(a.MD5[:])].Tags,
+		[]string{"solo", tag})
+
+	if len(thumbs) != 3 {
+		t.Fatalf("unexpected thumbnail count: %d", len(thumbs))
+	}
+	for _, src := range [...]map[[16]byte][]byte{thumbsA, thumbsB} {
+		for hash, thumb := range src {
+			name := archiveImageDir + hex.EncodeToString(hash[:])
+			if !bytes.Equal(thumbs[name], thumb) {
+				t.Fatalf("thumbnail not exported: %s", name)
+			}
+		}
+	}
+}
+
+func TestImportPool(t *testing.T) {
+	tag := test_utils.RandomTag()
+	img, thumbs := randomImage(t, 2, tag, "solo")
+	pooled, _ := insertPooled(t, 1, tag)
+
+	archive := writeArchive(t, thumbs, img, pooled, img)
+
+	imported, skipped, err := ImportPool(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, imported, 1)
+	assertEqual(t, skipped, 2)
+
+	images, err := db.GetImages([]string{tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("unexpected image count: %d", len(images))
+	}
+	for _, got := range images {
+		if got.MD5 != img.MD5 {
+			continue
+		}
+		assertEqual(t, got.Crops, img.Crops)
+		for hash, thumb := range thumbs {
+			buf, err := readThumbnail(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, thumb) {
+				t.Fatalf("thumbnail not imported: %x", hash)
+			}
+		}
+	}
+
+	// Importing again only skips duplicates
+	imported, skipped, err = ImportPool(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, imported, 0)
+	assertEqual(t, skipped, 3)
+}
+
+func TestImportPoolDuplicates(t *testing.T) {
+	tag := test_utils.RandomTag()
+	img, thumbs := randomImage(t, 1, tag)
+	similar, similarThumbs := randomImage(t, 1, tag)
+	similar.Crops[0].PHash = img.Crops[0].PHash ^ 1
+	pooled, _ := insertPooled(t, 1, tag)
+	conflicting, conflictingThumbs := randomImage(t, 1, tag)
+	delete(conflictingThumbs, conflicting.Crops[0].Hash)
+	conflicting.Crops[0].Hash = pooled.Crops[0].Hash
+	for _, m := range [...]map[[16]byte][]byte{
+		similarThumbs,
+		conflictingThumbs,
+	} {
+		for hash, thumb := range m {
+			thumbs[hash] = thumb
+		}
+	}
+
+	archive := writeArchive(t, thumbs, img, similar, conflicting)
+	imported, skipped, err := ImportPool(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, imported, 1)
+	assertEqual(t, skipped, 2)
+	for _, i := range [...]db.Image{similar, conflicting} {
+		inDB, err := db.IsInDatabase(i.MD5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inDB {
+			t.Fatalf("duplicate image imported: %x", i.MD5)
+		}
+	}
+}
+
+func TestImportPoolMissingThumbnail(t *testing.T) {
+	img, _ := randomImage(t, 1, test_utils.RandomTag())
+	manifest, err := json.Marshal(manifest{
+		Version: archiveVersion,
+		Images:  []manifestImage{encodeManifestImage(img)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w bytes.Buffer
+	tw := tar.NewWriter(&w)
+	err = tw.WriteHeader(&tar.Header{
+		Name: manifestName,
+		Mode: 0600,
+		Size: int64(len(manifest)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tw.Write(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ImportPool(&w)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	inDB, err := db.IsInDatabase(img.MD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inDB {
+		t.Fatal("image imported without thumbnail")
+	}
+}
@@ -1,7 +1,5 @@
 package captchouli
 
-// #include "thumbnail.h"
-import "C"
 import (
 	"compress/gzip"
 	"encoding/base64"
@@ -10,6 +8,7 @@ import (
 	"net/http"
 
 	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/danbooru"
 	"github.com/bakape/captchouli/v2/db"
 	"golang.org/x/net/html"
 )
@@ -27,6 +26,9 @@ type Error = common.Error
 var (
 	// No faces detected in downloaded image
 	ErrNoFace = Error{fmt.Errorf("no faces detected")}
+
+	// Image ingestion was attempted in a build without OpenCV
+	ErrNoOpenCV = Error{fmt.Errorf("built without OpenCV")}
 )
 
 // Init storage and start the runtime
@@ -36,14 +38,35 @@ func Open() error {
 
 // Close open resources
 func Close() error {
-	classifierMu.Lock()
-	C.cpli_unload_classifier(classifier)
-	classifier = nil
-	classifierMu.Unlock()
-
+	closeDetector()
 	return db.Close()
 }
 
+// Tag rules applied to posts fetched from boorus
+type ContentFilter = common.ContentFilter
+
+// Tag rules for posts fetched for a specific captcha tag
+type ContentOverride = common.ContentOverride
+
+// Blacklist images in the pool, that are tagged with any tag blacklisted by
+// default or by f. Use after adding tags to the blacklist to remove already
+// pooled images. Returns the number of blacklisted source images.
+// Requires Open to have been called.
+func ReevaluateBlacklist(f ContentFilter) (int, error) {
+	return danbooru.Reevaluate(f)
+}
+
+// Clear the cache of Danbooru pages fetched for tag, so pages are fetched
+// again starting with the first one. Use to pick up new uploads before the
+// cache expires. Requires Open to have been called.
+func ResetPageCache(tag string) (err error) {
+	tag, _, err = db.ResolveTagAlias(tag)
+	if err != nil {
+		return
+	}
+	return db.ResetPageCache(tag)
+}
+
 // Extact captcha ID and solution from request
 func ExtractSolution(r *http.Request) (solution []byte, err error) {
 	err = r.ParseForm()
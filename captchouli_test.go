@@ -1,20 +1,56 @@
 package captchouli
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/bakape/captchouli/v2/db"
+	"github.com/bakape/captchouli/v2/test_utils"
+)
+
+var (
+	booru *test_utils.FakeDanbooru
+
+	// Tags served by booru. Unique to the test run, as the test database
+	// persists between runs.
+	testTags [3]string
+
+	// Passed as Options.DuplicateDistance to disable near-duplicate detection
+	noDuplicateDetection = -1
 )
 
 func TestMain(t *testing.M) {
 	db.OpenForTests()
-	os.Exit(t.Run())
+
+	img, err := ioutil.ReadFile(filepath.Join("testdata", "sample.jpg"))
+	if err != nil {
+		panic(err)
+	}
+	booru = test_utils.NewFakeDanbooru(img)
+	for i := range testTags {
+		testTags[i] = test_utils.RandomTag()
+		booru.AddTag(testTags[i], 12)
+	}
+
+	code := t.Run()
+	booru.Close()
+	os.Exit(code)
 }
 
 func newService(t *testing.T) *Service {
+	if !openCVEnabled {
+		t.Skip("populating image pools requires OpenCV")
+	}
 	s, err := NewService(Options{
-		Tags: []string{"patchouli_knowledge", "cirno", "hakurei_reimu"},
+		Tags: testTags[:],
+		Danbooru: DanbooruOptions{
+			BaseURL:   booru.URL,
+			RateLimit: 1000,
+		},
+		// All fake posts share the same image
+		DuplicateDistance: &noDuplicateDetection,
 	})
 	if err != nil {
 		t.Fatal(err)
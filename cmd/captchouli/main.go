@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/bakape/captchouli/v2"
@@ -19,13 +21,140 @@ func main() {
 	address := flag.String("a", ":8512", "address for server to listen on")
 	explicit := flag.Bool("e", false,
 		"allow explicit rating images in the pool")
+	metrics := flag.Bool("m", false,
+		"expose Prometheus-compatible metrics on /metrics")
+	background := flag.Bool("b", false,
+		"start listening immediately and initialize tag pools in the background")
+	serveOnly := flag.Bool("s", false,
+		"only serve captchas from the existing image pool without fetching new images")
+	similar := flag.Bool("d", false,
+		"prefer distractor images sharing hair and eye colour with the matching images")
+	exclude := flag.String("x", "",
+		`Semicolon-separated groups of comma-separated equivalent tags.
+Images with tags equivalent to the captcha tag are not used as distractors.
+`)
+	minTags := flag.Int("n", 0,
+		"minimum number of tags of distractor images")
+	blacklist := flag.String("B", "",
+		"comma-separated list of tags to blacklist in addition to the defaults")
+	require := flag.String("R", "",
+		"comma-separated list of tags fetched images must contain")
+	proxy := flag.String("p", "",
+		"URL of proxy to send Danbooru requests through")
+	target := flag.Int("T", captchouli.DefaultPrefetchTarget,
+		"number of images to populate the pool of each tag with on prefetch")
+	workers := flag.Int("w", 0,
+		"number of tags to prefetch in parallel (default face detector concurrency)")
 	tags := flag.String("t", strings.Join(defaultTags[:], ","),
 		`Comma-separated list of tags to use in the pool. At least 3 required.
 Note that only tags that are detectable from the character's face should be used.
 `)
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			`Usage: %s [flags] [command]
+
+Commands:
+  serve       serve captchas over HTTP (default)
+  prefetch    populate the image pools of all tags and exit. Can be
+              interrupted and resumed by running it again.
+  reevaluate  blacklist pooled images matching the content filter and exit
+  reset-pages TAG...
+              clear the cache of Danbooru pages fetched for tags and exit
+  export FILE [TAG...]
+              write the pooled images of tags to a tar archive and exit.
+              Exports the entire pool, if no tags are passed.
+  import FILE...
+              add the images of archives written by export to the pool
+              and exit
+
+Danbooru credentials are read from the DANBOORU_LOGIN and DANBOORU_API_KEY
+environment variables.
+
+Flags:
+`,
+			os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	var content captchouli.ContentFilter
+	if *blacklist != "" {
+		content.Blacklist = strings.Split(*blacklist, ",")
+	}
+	if *require != "" {
+		content.Require = strings.Split(*require, ",")
+	}
+
+	opts := captchouli.Options{
+		Tags:       strings.Split(*tags, ","),
+		Metrics:    *metrics,
+		Background: *background,
+		ServeOnly:  *serveOnly,
+		Content:    content,
+		Danbooru: captchouli.DanbooruOptions{
+			Login:  os.Getenv("DANBOORU_LOGIN"),
+			APIKey: os.Getenv("DANBOORU_API_KEY"),
+			Proxy:  *proxy,
+		},
+	}
+	opts.Distractors.MinTags = *minTags
+	if *exclude != "" {
+		for _, g := range strings.Split(*exclude, ";") {
+			opts.Distractors.Exclude = append(opts.Distractors.Exclude,
+				strings.Split(g, ","))
+		}
+	}
+	if *similar {
+		opts.Distractors.Strategy = captchouli.SimilarDistractors
+	}
+	if *explicit {
+		opts.Explicitness = []captchouli.Rating{captchouli.Safe,
+			captchouli.Questionable, captchouli.Explicit}
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+	case "prefetch":
+		err := prefetch(opts, captchouli.PrefetchOptions{
+			Target:  *target,
+			Workers: *workers,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "reevaluate":
+		err := reevaluate(content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "reset-pages":
+		err := resetPages(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "export":
+		if flag.NArg() < 2 {
+			log.Fatal("no archive path provided")
+		}
+		err := exportPool(flag.Arg(1), flag.Args()[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "import":
+		err := importPool(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command: %s", cmd)
+	}
+
 	var s *captchouli.Service
 	err := func() (err error) {
 		err = captchouli.Open()
@@ -33,18 +162,9 @@ Note that only tags that are detectable from the character's face should be used
 			return
 		}
 
-		tags := strings.Split(*tags, ",")
-		if len(tags) < 3 {
+		if len(opts.Tags) < 3 {
 			return fmt.Errorf("not enough tags provided")
 		}
-		opts := captchouli.Options{
-			Tags: tags,
-		}
-		if *explicit {
-			opts.Explicitness = []captchouli.Rating{captchouli.Safe,
-				captchouli.Questionable, captchouli.Explicit}
-		}
-
 		s, err = captchouli.NewService(opts)
 		return
 	}()
@@ -56,3 +176,136 @@ Note that only tags that are detectable from the character's face should be used
 	log.Println("listening on " + *address)
 	log.Println(http.ListenAndServe(*address, s.Router()))
 }
+
+// Populate the image pools of all tags, logging progress
+func prefetch(opts captchouli.Options, p captchouli.PrefetchOptions,
+) (err error) {
+	err = captchouli.Open()
+	if err != nil {
+		return
+	}
+	defer captchouli.Close()
+
+	p.Progress = func(pr captchouli.PrefetchProgress) {
+		switch {
+		case pr.Err != nil:
+			log.Printf("[%d/%d] %s: failed with %d/%d images: %s\n",
+				pr.TagsDone, pr.Tags, pr.Tag, pr.Images, pr.Target, pr.Err)
+		case pr.Exhausted:
+			log.Printf("[%d/%d] %s: no more images on Danbooru; %d/%d images\n",
+				pr.TagsDone, pr.Tags, pr.Tag, pr.Images, pr.Target)
+		case pr.Done:
+			log.Printf("[%d/%d] %s: done with %d/%d images\n",
+				pr.TagsDone, pr.Tags, pr.Tag, pr.Images, pr.Target)
+		default:
+			log.Printf("[%d/%d] %s: %d/%d images after %d fetches\n",
+				pr.TagsDone, pr.Tags, pr.Tag, pr.Images, pr.Target,
+				pr.Fetches)
+		}
+	}
+	return captchouli.Prefetch(opts, p)
+}
+
+// Retroactively blacklist pooled images matching the content filter
+func reevaluate(f captchouli.ContentFilter) (err error) {
+	err = captchouli.Open()
+	if err != nil {
+		return
+	}
+	defer captchouli.Close()
+
+	n, err := captchouli.ReevaluateBlacklist(f)
+	if err != nil {
+		return
+	}
+	log.Printf("blacklisted %d images\n", n)
+	return
+}
+
+// Clear the Danbooru page caches of tags
+func resetPages(tags []string) (err error) {
+	if len(tags) == 0 {
+		return fmt.Errorf("no tags provided")
+	}
+	err = captchouli.Open()
+	if err != nil {
+		return
+	}
+	defer captchouli.Close()
+
+	for _, t := range tags {
+		err = captchouli.ResetPageCache(t)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Write the pooled images of tags to an archive at path
+func exportPool(path string, tags []string) (err error) {
+	err = captchouli.Open()
+	if err != nil {
+		return
+	}
+	defer captchouli.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	n, err := captchouli.ExportPool(w, tags)
+	if err != nil {
+		return
+	}
+	err = w.Flush()
+	if err != nil {
+		return
+	}
+	log.Printf("exported %d images to %s\n", n, path)
+	return
+}
+
+// Add the images of archives at paths to the pool
+func importPool(paths []string) (err error) {
+	if len(paths) == 0 {
+		return fmt.Errorf("no archive paths provided")
+	}
+	err = captchouli.Open()
+	if err != nil {
+		return
+	}
+	defer captchouli.Close()
+
+	for _, p := range paths {
+		err = func() (err error) {
+			f, err := os.Open(p)
+			if err != nil {
+				return
+			}
+			defer f.Close()
+
+			imported, skipped, err := captchouli.ImportPool(bufio.NewReader(f))
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			log.Printf("imported %d images from %s; skipped %d duplicates\n",
+				imported, p, skipped)
+			return
+		}()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
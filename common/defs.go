@@ -21,6 +21,9 @@ const (
 
 var (
 	ErrNoMatch = Error{errors.New("not enough images match tag")}
+
+	// Not enough pooled images pass the filters to fill a captcha
+	ErrNotEnoughImages = Error{errors.New("not enough images for captcha")}
 )
 
 func (d DataSource) String() string {
@@ -46,3 +49,83 @@ type Error struct {
 func (e Error) Error() string {
 	return "captchouli: " + e.Err.Error()
 }
+
+// Quality metrics of a face crop
+type Quality struct {
+	// Side of the square crop in source image pixels
+	FaceSize int
+
+	// Crop area divided by source image area
+	RelativeSize float64
+
+	// Variance of the Laplacian of the crop luminance. Higher is sharper.
+	Sharpness float64
+
+	// Standard deviation of the crop luminance in the [0;255] range
+	Contrast float64
+
+	// Detector-specific confidence of the face detection
+	Confidence float64
+
+	// Ratio of the shorter to the longer side of the detected face in the
+	// [0;1] range
+	Aspect float64
+}
+
+// Strategy for selecting images not matching the captcha tag
+type DistractorStrategy uint8
+
+const (
+	// Select distractors at random
+	RandomDistractors DistractorStrategy = iota
+
+	// Prefer distractors sharing the most tags with the matching images of the
+	// captcha
+	SimilarDistractors
+)
+
+// Selection of images not matching the captcha tag
+type Distractors struct {
+	Strategy DistractorStrategy
+
+	// Glob patterns of tags compared by SimilarDistractors, such as "*_hair"
+	// or the name of a copyright
+	Tags []string
+
+	// Groups of semantically equivalent or related tags, such as similar
+	// facial expressions. Distractors never contain any tag sharing a group
+	// with the captcha tag. Danbooru aliases and implications of these tags
+	// are excluded automatically.
+	Exclude [][]string
+
+	// Minimum number of tags of distractors. Sparsely tagged images are more
+	// likely to be missing tags of features they depict.
+	MinTags int
+}
+
+// Tag rules applied to posts fetched from boorus
+type ContentFilter struct {
+	// Posts with any of these tags are blacklisted in addition to the default
+	// blacklist
+	Blacklist []string
+
+	// Posts must contain all of these tags
+	Require []string
+
+	// Rules extending the above for posts fetched for specific captcha tags.
+	// Keyed by captcha tag. Keys are matched to captcha tags after resolving
+	// Danbooru tag aliases.
+	Overrides map[string]ContentOverride
+}
+
+// Tag rules for posts fetched for a specific captcha tag
+type ContentOverride struct {
+	// Additional blacklisted tags
+	Blacklist []string
+
+	// Tags exempt from the blacklist, including the default blacklist
+	Allow []string
+
+	// Additional required tags
+	Require []string
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Severity of a log message
+type LogLevel uint8
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Receives structured log messages. keyvals is an alternating list of field
+// names and values, such as "tag", "cirno", "error", err.
+//
+// Commonly used field names are "tag", "md5" (hex-encoded), "source",
+// "duration" (time.Duration) and "error" (error).
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+var (
+	loggerMu sync.RWMutex
+	logger   Logger = NewLogger(nil, LevelInfo)
+)
+
+// Set the process-wide logger used by all captchouli packages
+func SetLogger(l Logger) {
+	loggerMu.Lock()
+	defer loggerMu.Unlock()
+	logger = l
+}
+
+// Log message with the process-wide logger
+func Log(level LogLevel, msg string, keyvals ...interface{}) {
+	loggerMu.RLock()
+	l := logger
+	loggerMu.RUnlock()
+	l.Log(level, msg, keyvals...)
+}
+
+func LogDebug(msg string, keyvals ...interface{}) {
+	Log(LevelDebug, msg, keyvals...)
+}
+
+func LogInfo(msg string, keyvals ...interface{}) {
+	Log(LevelInfo, msg, keyvals...)
+}
+
+func LogWarn(msg string, keyvals ...interface{}) {
+	Log(LevelWarn, msg, keyvals...)
+}
+
+func LogError(msg string, keyvals ...interface{}) {
+	Log(LevelError, msg, keyvals...)
+}
+
+// Writes messages at or above a minimum level as logfmt lines
+type logfmtLogger struct {
+	min LogLevel
+	l   *log.Logger
+	now func() time.Time
+}
+
+// Create a Logger, that writes messages at or above min to w in logfmt
+// format. If w is nil, messages are written to the output of the standard
+// library's default logger.
+func NewLogger(w io.Writer, min LogLevel) Logger {
+	l := logfmtLogger{
+		min: min,
+		now: time.Now,
+	}
+	if w != nil {
+		l.l = log.New(w, "", 0)
+	}
+	return l
+}
+
+func (l logfmtLogger) Log(level LogLevel, msg string,
+	keyvals ...interface{},
+) {
+	if level < l.min {
+		return
+	}
+
+	var w bytes.Buffer
+	w.WriteString("ts=")
+	w.WriteString(l.now().Format(time.RFC3339))
+	w.WriteString(" level=")
+	w.WriteString(level.String())
+	w.WriteString(" component=captchouli msg=")
+	writeLogfmtValue(&w, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		w.WriteByte(' ')
+		fmt.Fprint(&w, keyvals[i])
+		w.WriteByte('=')
+		if i+1 < len(keyvals) {
+			writeLogfmtValue(&w, keyvals[i+1])
+		}
+	}
+
+	out := l.l
+	if out == nil {
+		// Follow output changes of the default logger
+		out = log.New(log.Writer(), "", 0)
+	}
+	out.Print(w.String())
+}
+
+func writeLogfmtValue(w *bytes.Buffer, v interface{}) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case time.Duration:
+		s = v.String()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		fmt.Fprintf(w, "%q", s)
+	} else {
+		w.WriteString(s)
+	}
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelInfo).(logfmtLogger)
+	l.now = func() time.Time {
+		return time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	}
+
+	l.Log(LevelDebug, "hidden")
+	if buf.Len() != 0 {
+		t.Fatal(buf.String())
+	}
+
+	l.Log(LevelError, "fetch error",
+		"tag", ":>",
+		"duration", time.Second,
+		"error", errors.New("not found"),
+		"source", Danbooru,
+	)
+	const std = `ts=2026-10-19T12:00:00Z level=error component=captchouli ` +
+		`msg="fetch error" tag=:> duration=1s error="not found" ` +
+		`source=danBooru` + "\n"
+	if s := buf.String(); s != std {
+		t.Fatalf("\n%s\n%s", s, std)
+	}
+}
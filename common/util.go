@@ -1,27 +1,77 @@
 package common
 
 import (
+	cryptoMD5 "crypto/md5"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"math/big"
 	mRand "math/rand"
 	"path/filepath"
-	"time"
+	"sync"
 )
 
-func init() {
-	mRand.Seed(time.Now().UnixNano())
-}
+var (
+	// Random decisions of captcha generation, such as the choice of tag,
+	// images, their order and thumbnail distortions
+	CaptchaRand = NewRand(CryptoSource)
+
+	// Random decisions of image fetching. Separate from CaptchaRand, so
+	// concurrent fetching does not affect generated captchas.
+	FetchRand = NewRand(CryptoSource)
+)
 
-// Returns a cryptographically secure pseudorandom int in the interval [0;max)
-func RandomInt(max int) int {
-	i, _ := rand.Int(rand.Reader, big.NewInt(int64(max)))
-	if i == nil {
-		return mRand.Int() % max // Fallback
+// Set the source of all random decisions. A source with a fixed seed makes
+// generated captchas reproducible. Captcha IDs are always cryptographically
+// secure. The source need not be safe for concurrent use. nil restores the
+// default cryptographically secure source.
+func SetRandomSource(src mRand.Source) {
+	if src == nil {
+		CaptchaRand.SetSource(CryptoSource)
+		FetchRand.SetSource(CryptoSource)
+		return
 	}
-	return int(i.Int64())
+	FetchRand.SetSource(mRand.NewSource(src.Int63()))
+	CaptchaRand.SetSource(src)
+}
+
+// Stream of pseudorandom numbers safe for concurrent use
+type Rand struct {
+	mu  sync.Mutex
+	rng *mRand.Rand
+}
+
+// Create a stream of pseudorandom numbers drawn from src
+func NewRand(src mRand.Source) *Rand {
+	return &Rand{rng: mRand.New(src)}
+}
+
+// Replace the source of the stream
+func (r *Rand) SetSource(src mRand.Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rng = mRand.New(src)
+}
+
+// Returns a pseudorandom int in the interval [0;max)
+func (r *Rand) Int(max int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Intn(max)
+}
+
+// Returns a non-negative pseudorandom int64
+func (r *Rand) Int63() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Int63()
+}
+
+// Pseudorandomly shuffle n elements
+func (r *Rand) Shuffle(n int, swap func(i, j int)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rng.Shuffle(n, swap)
 }
 
 // Decode hex string to MD5 hash
@@ -41,6 +91,19 @@ func ThumbPath(md5 [16]byte) string {
 	return filepath.Join(RootDir, "images", hex.EncodeToString(md5[:]))
 }
 
+// Return the hash identifying the i-th thumbnail cropped from the source image
+// with the passed MD5 hash. The first crop is identified by the source hash
+// itself.
+func CropHash(md5 [16]byte, i int) [16]byte {
+	if i == 0 {
+		return md5
+	}
+	var buf [24]byte
+	copy(buf[:], md5[:])
+	binary.LittleEndian.PutUint64(buf[16:], uint64(i))
+	return cryptoMD5.Sum(buf[:])
+}
+
 // Source of cryptographically secure integers
 var CryptoSource mRand.Source = new(cryptoSource)
 
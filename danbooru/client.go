@@ -0,0 +1,312 @@
+package danbooru
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakape/captchouli/v2/common"
+)
+
+const (
+	// Root URL of the Danbooru API, if none is configured
+	DefaultBaseURL = "https://danbooru.donmai.us"
+
+	// User-Agent header sent with requests, if none is configured
+	DefaultUserAgent = "captchouli/2 (+https://github.com/bakape/captchouli)"
+
+	// Maximum size of downloaded images, if none is configured
+	DefaultMaxDownloadSize = 32 << 20
+
+	defaultRateLimit  = 2
+	defaultBurst      = 4
+	defaultMaxRetries = 5
+	maxBackoff        = time.Minute
+)
+
+var (
+	// Configured API client settings
+	options   Options
+	client    *http.Client
+	optionsMu sync.RWMutex
+
+	// Shared by all requests of the process
+	limiter = newTokenBucket(defaultRateLimit, defaultBurst)
+
+	// Delay before the first retry of a failed request. Doubled on each
+	// further retry.
+	retryBase = time.Second
+)
+
+// Danbooru API client settings
+type Options struct {
+	// Root URL of the Danbooru API. Defaults to DefaultBaseURL.
+	BaseURL string
+
+	// Danbooru account name and API key. Authenticated requests are subject
+	// to higher rate limits.
+	Login, APIKey string
+
+	// User-Agent header sent with all requests. Defaults to DefaultUserAgent.
+	UserAgent string
+
+	// Maximum sustained rate of requests per second. Defaults to 2.
+	RateLimit float64
+
+	// Maximum number of requests sent in a burst. Defaults to 4.
+	Burst int
+
+	// Maximum number of retries of rate limited or failed requests. Negative
+	// values disable retries. Defaults to 5.
+	MaxRetries int
+
+	// Client used for all API requests and image downloads. Defaults to a
+	// client with connection, response header and overall request timeouts,
+	// that uses Proxy.
+	Client *http.Client
+
+	// URL of the proxy to send requests through. Ignored, if Client is set.
+	// Defaults to the proxy set by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables.
+	Proxy string
+
+	// Maximum size of downloaded images in bytes. Larger images are skipped.
+	// Defaults to DefaultMaxDownloadSize.
+	MaxDownloadSize int64
+
+	// Duration fetched pages of tag queries are cached for. After expiry
+	// pages are fetched again to pick up new uploads. Defaults to 24 hours.
+	PageCacheTTL time.Duration
+}
+
+// Set Danbooru API client settings
+func Configure(opts Options) (err error) {
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+	if opts.BaseURL == "" {
+		opts.BaseURL = DefaultBaseURL
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = DefaultUserAgent
+	}
+	if opts.RateLimit <= 0 {
+		opts.RateLimit = defaultRateLimit
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = defaultBurst
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+	if opts.MaxDownloadSize <= 0 {
+		opts.MaxDownloadSize = DefaultMaxDownloadSize
+	}
+	if opts.PageCacheTTL <= 0 {
+		opts.PageCacheTTL = 24 * time.Hour
+	}
+	c := opts.Client
+	if c == nil {
+		c, err = newClient(opts.Proxy)
+		if err != nil {
+			return
+		}
+	}
+
+	optionsMu.Lock()
+	defer optionsMu.Unlock()
+	options = opts
+	client = c
+	limiter.configure(opts.RateLimit, opts.Burst)
+	return
+}
+
+// Create a client with default timeouts sending requests through proxy, if
+// set
+func newClient(proxy string) (c *http.Client, err error) {
+	proxyFn := http.ProxyFromEnvironment
+	if proxy != "" {
+		var u *url.URL
+		u, err = url.Parse(proxy)
+		if err != nil {
+			err = common.Error{Err: fmt.Errorf("invalid proxy URL: %w", err)}
+			return
+		}
+		proxyFn = http.ProxyURL(u)
+	}
+	c = &http.Client{
+		Timeout: 2 * time.Minute,
+		Transport: &http.Transport{
+			Proxy: proxyFn,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          16,
+		},
+	}
+	return
+}
+
+func getOptions() (Options, *http.Client) {
+	optionsMu.RLock()
+	defer optionsMu.RUnlock()
+	return options, client
+}
+
+func baseURL() string {
+	opts, _ := getOptions()
+	return opts.BaseURL
+}
+
+func init() {
+	if err := Configure(Options{}); err != nil {
+		panic(err)
+	}
+}
+
+// Token bucket rate limiter
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) configure(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = math.Min(b.tokens, b.burst)
+}
+
+// Must be called with b.mu held
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst,
+		b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Block until a token is available and take it
+func (b *tokenBucket) wait() {
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens--
+	// Reserve the token even if it is not yet available so concurrent
+	// callers queue up behind each other
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Send a rate limited GET request to url. Requests failing with 429 or a
+// server error are retried with exponential backoff, honouring any
+// Retry-After header. Non-200 responses are returned as errors. Credentials
+// are only sent to the API host and not to image hosts.
+func get(url string) (res *http.Response, err error) {
+	opts, client := getOptions()
+	auth := opts.Login != "" && sameHost(url, opts.BaseURL)
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("User-Agent", opts.UserAgent)
+		if auth {
+			req.SetBasicAuth(opts.Login, opts.APIKey)
+		}
+
+		limiter.wait()
+		res, err = client.Do(req)
+		if err != nil {
+			return
+		}
+		if res.StatusCode == http.StatusOK {
+			return
+		}
+
+		status := res.StatusCode
+		retry := status == http.StatusTooManyRequests || status >= 500
+		delay := backoff(attempt, res.Header.Get("Retry-After"))
+		// Drain body to allow connection reuse
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+		res.Body.Close()
+		res = nil
+
+		if !retry || attempt >= opts.MaxRetries {
+			err = common.Error{Err: fmt.Errorf("%s: unexpected status: %d",
+				url, status)}
+			return
+		}
+		common.LogWarn("retrying danbooru request", "url", url,
+			"status", status, "attempt", attempt+1, "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+// Return, if both URLs have the same scheme and host
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// Return the delay before retrying a request for the attempt-th time.
+// retryAfter is the value of the Retry-After response header, if any. The
+// delay never exceeds maxBackoff, as fetches are serialized by mu.
+func backoff(attempt int, retryAfter string) time.Duration {
+	if retryAfter != "" {
+		if s, err := strconv.Atoi(retryAfter); err == nil && s >= 0 {
+			if s >= int(maxBackoff/time.Second) {
+				return maxBackoff
+			}
+			return time.Duration(s) * time.Second
+		}
+		if t, err := http.ParseTime(retryAfter); err == nil {
+			d := time.Until(t)
+			switch {
+			case d <= 0:
+				return 0
+			case d > maxBackoff:
+				return maxBackoff
+			}
+			return d
+		}
+	}
+	d := retryBase << uint(attempt)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
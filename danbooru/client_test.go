@@ -0,0 +1,196 @@
+package danbooru
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if ua := r.Header.Get("User-Agent"); ua != "test" {
+				t.Errorf("unexpected User-Agent: %s", ua)
+			}
+			if login, key, ok := r.BasicAuth(); !ok || login != "cirno" ||
+				key != "baka" {
+				t.Errorf("unexpected credentials: %s %s", login, key)
+			}
+			switch atomic.AddInt32(&requests, 1) {
+			case 1:
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			case 2:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				w.Write([]byte("[]"))
+			}
+		}))
+	defer srv.Close()
+
+	Configure(Options{
+		BaseURL:   srv.URL,
+		Login:     "cirno",
+		APIKey:    "baka",
+		UserAgent: "test",
+		RateLimit: 1000,
+	})
+	defer Configure(testOptions)
+
+	base := retryBase
+	retryBase = time.Millisecond
+	defer func() {
+		retryBase = base
+	}()
+
+	r, err := get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if requests != 3 {
+		t.Fatalf("unexpected request count: %d", requests)
+	}
+
+	srv.Config.Handler = http.NotFoundHandler()
+	_, err = get(srv.URL)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCredentialsOnlySentToAPI(t *testing.T) {
+	authenticated := func(want bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if _, _, ok := r.BasicAuth(); ok != want {
+					t.Errorf("unexpected authentication of %s: %t", r.Host, ok)
+				}
+			}))
+	}
+	api := authenticated(true)
+	defer api.Close()
+	cdn := authenticated(false)
+	defer cdn.Close()
+
+	Configure(Options{
+		BaseURL:   api.URL,
+		Login:     "cirno",
+		APIKey:    "baka",
+		RateLimit: 1000,
+	})
+	defer Configure(testOptions)
+
+	for _, u := range [...]string{api.URL + "/posts.json",
+		cdn.URL + "/data/image.jpg"} {
+		r, err := get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := [...]struct {
+		name       string
+		attempt    int
+		retryAfter string
+		delay      time.Duration
+	}{
+		{"seconds", 0, "3", 3 * time.Second},
+		{"capped seconds", 0, "86400", maxBackoff},
+		{"overflowing seconds", 0, "9223372036854775807", maxBackoff},
+		{"past date", 0, "Mon, 02 Jan 2006 15:04:05 GMT", 0},
+		{"capped date", 0, "Fri, 31 Dec 9999 23:59:59 GMT", maxBackoff},
+		{"exponential", 2, "", 4 * time.Second},
+		{"capped", 30, "", maxBackoff},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			if d := backoff(c.attempt, c.retryAfter); d != c.delay {
+				t.Fatalf("unexpected delay: %s != %s", d, c.delay)
+			}
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(20, 2)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		b.wait()
+	}
+	// 2 tokens available immediately and 2 more added in 100ms
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("rate limit not applied: %s", d)
+	}
+}
+
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (fn roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return fn(r)
+}
+
+func TestCustomClient(t *testing.T) {
+	var used bool
+	err := Configure(Options{
+		Client: &http.Client{
+			Transport: roundTripper(func(r *http.Request,
+			) (*http.Response, error) {
+				used = true
+				return http.DefaultTransport.RoundTrip(r)
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(testOptions)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	r, err := get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if !used {
+		t.Fatal("custom client not used")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&proxied, 1)
+		}))
+	defer proxy.Close()
+	defer Configure(testOptions)
+
+	err := Configure(Options{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := get("http://danbooru.invalid/posts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if proxied != 1 {
+		t.Fatal("request not proxied")
+	}
+
+	err = Configure(Options{Proxy: ":invalid"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
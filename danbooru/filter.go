@@ -0,0 +1,187 @@
+package danbooru
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+)
+
+var (
+	// Configured content rules
+	filter   common.ContentFilter
+	filterMu sync.RWMutex
+)
+
+// Tag rules for posts fetched for a captcha tag
+type rules struct {
+	blacklist map[string]struct{}
+	require   []string
+}
+
+// Set tag rules applied to fetched posts in addition to the default blacklist
+func SetContentFilter(f common.ContentFilter) {
+	f = normalizeFilter(f)
+
+	filterMu.Lock()
+	defer filterMu.Unlock()
+	filter = f
+}
+
+// Return a lowercased deep copy of f
+func normalizeFilter(f common.ContentFilter) common.ContentFilter {
+	lower := func(tags []string) []string {
+		dst := make([]string, len(tags))
+		for i, t := range tags {
+			dst[i] = strings.ToLower(t)
+		}
+		return dst
+	}
+
+	overrides := make(map[string]common.ContentOverride, len(f.Overrides))
+	for tag, o := range f.Overrides {
+		overrides[strings.ToLower(tag)] = common.ContentOverride{
+			Blacklist: lower(o.Blacklist),
+			Allow:     lower(o.Allow),
+			Require:   lower(o.Require),
+		}
+	}
+	return common.ContentFilter{
+		Blacklist: lower(f.Blacklist),
+		Require:   lower(f.Require),
+		Overrides: overrides,
+	}
+}
+
+// Return overrides keyed by the current names of their captcha tags in the
+// local alias table. Overrides of tags aliased to the same tag are merged.
+func resolveOverrides(overrides map[string]common.ContentOverride,
+) (resolved map[string]common.ContentOverride, err error) {
+	resolved = make(map[string]common.ContentOverride, len(overrides))
+	for tag, o := range overrides {
+		tag, _, err = db.ResolveTagAlias(tag)
+		if err != nil {
+			return
+		}
+		if prev, ok := resolved[tag]; ok {
+			o = common.ContentOverride{
+				Blacklist: append(prev.Blacklist, o.Blacklist...),
+				Allow:     append(prev.Allow, o.Allow...),
+				Require:   append(prev.Require, o.Require...),
+			}
+		}
+		resolved[tag] = o
+	}
+	return
+}
+
+// Return the tag rules for posts fetched for the alias-resolved tag
+func rulesFor(tag string) (r rules, err error) {
+	filterMu.RLock()
+	defer filterMu.RUnlock()
+
+	overrides, err := resolveOverrides(filter.Overrides)
+	if err != nil {
+		return
+	}
+	o := overrides[tag]
+	r.blacklist = make(map[string]struct{},
+		len(blacklisted)+len(filter.Blacklist)+len(o.Blacklist))
+	for _, src := range [...][]string{filter.Blacklist, o.Blacklist} {
+		for _, t := range src {
+			r.blacklist[t] = struct{}{}
+		}
+	}
+	for t := range blacklisted {
+		r.blacklist[t] = struct{}{}
+	}
+	for _, t := range o.Allow {
+		delete(r.blacklist, t)
+	}
+	r.require = append(append([]string(nil), filter.Require...),
+		o.Require...)
+	return
+}
+
+// Blacklist already stored images, that do not pass the default blacklist
+// and the blacklisted tags of f or miss its required tags. Returns the number
+// of newly blacklisted source images.
+func Reevaluate(f common.ContentFilter) (n int, err error) {
+	f = normalizeFilter(f)
+	f.Overrides, err = resolveOverrides(f.Overrides)
+	if err != nil {
+		return
+	}
+
+	// Captcha tags exempt from each blacklisted tag
+	exempt := make(map[string][]string)
+	for t := range blacklisted {
+		exempt[t] = nil
+	}
+	for _, t := range f.Blacklist {
+		exempt[t] = nil
+	}
+	for tag, o := range f.Overrides {
+		for _, t := range o.Allow {
+			if ex, ok := exempt[t]; ok {
+				exempt[t] = append(ex, tag)
+			}
+		}
+	}
+
+	// Deterministic order for logging
+	tags := make([]string, 0, len(exempt))
+	for t := range exempt {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+
+	report := func(m int, err error, msg string, tags []string, with string,
+	) error {
+		if err != nil {
+			return err
+		}
+		if m != 0 {
+			common.LogInfo(msg, "tags", tags, "tag", with, "images", m)
+		}
+		n += m
+		return nil
+	}
+	blacklist := func(tags []string, with string, except []string) error {
+		m, err := db.BlacklistTagged(tags, with, except)
+		return report(m, err, "blacklisted stored images", tags, with)
+	}
+	require := func(tags []string, with string) error {
+		m, err := db.BlacklistUntagged(tags, with)
+		return report(m, err, "blacklisted stored images missing tags",
+			tags, with)
+	}
+	for _, t := range tags {
+		err = blacklist([]string{t}, "", exempt[t])
+		if err != nil {
+			return
+		}
+	}
+	for tag, o := range f.Overrides {
+		if len(o.Blacklist) == 0 {
+			continue
+		}
+		err = blacklist(o.Blacklist, tag, nil)
+		if err != nil {
+			return
+		}
+	}
+	err = require(f.Require, "")
+	if err != nil {
+		return
+	}
+	for tag, o := range f.Overrides {
+		err = require(o.Require, tag)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package danbooru
+
+import (
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"github.com/bakape/boorufetch"
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+	"github.com/bakape/captchouli/v2/test_utils"
+)
+
+func TestContentFilter(t *testing.T) {
+	old, renamed := test_utils.RandomTag(), test_utils.RandomTag()
+	err := db.SetTagAlias(old, renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetContentFilter(common.ContentFilter{
+		Blacklist: []string{"Comic"},
+		Require:   []string{"smile"},
+		Overrides: map[string]common.ContentOverride{
+			"Cosplayer": {
+				Blacklist: []string{"hat"},
+				Allow:     []string{"cosplay", "comic"},
+				Require:   []string{"1girl"},
+			},
+			old: {
+				Blacklist: []string{"hat"},
+				Require:   []string{"solo"},
+			},
+		},
+	})
+	defer SetContentFilter(common.ContentFilter{})
+
+	cases := [...]struct {
+		name, tag string
+		banned    []string
+		allowed   []string
+		require   []string
+	}{
+		{
+			name:    "default",
+			tag:     "cirno",
+			banned:  []string{"comic", "cosplay", "photo"},
+			allowed: []string{"hat"},
+			require: []string{"smile"},
+		},
+		{
+			name:    "override",
+			tag:     "cosplayer",
+			banned:  []string{"hat", "photo"},
+			allowed: []string{"comic", "cosplay"},
+			require: []string{"smile", "1girl"},
+		},
+		{
+			name:    "aliased override",
+			tag:     renamed,
+			banned:  []string{"comic", "hat"},
+			require: []string{"smile", "solo"},
+		},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			r, err := rulesFor(c.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tag := range c.banned {
+				if _, ok := r.blacklist[tag]; !ok {
+					t.Errorf("tag not blacklisted: %s", tag)
+				}
+			}
+			for _, tag := range c.allowed {
+				if _, ok := r.blacklist[tag]; ok {
+					t.Errorf("tag blacklisted: %s", tag)
+				}
+			}
+			if !reflect.DeepEqual(r.require, c.require) {
+				t.Errorf("required tags mismatch: %v != %v", r.require,
+					c.require)
+			}
+		})
+	}
+}
+
+func TestReevaluateRequire(t *testing.T) {
+	old, tag, req := test_utils.RandomTag(), test_utils.RandomTag(),
+		test_utils.RandomTag()
+	err := db.SetTagAlias(old, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tags := range [...][]string{{tag, req}, {tag}, {req}} {
+		img := db.Image{
+			Rating: boorufetch.Questionable,
+			Source: common.Danbooru,
+			Tags:   tags,
+		}
+		_, err = rand.Read(img.MD5[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.InsertImage(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := Reevaluate(common.ContentFilter{
+		Overrides: map[string]common.ContentOverride{
+			old: {
+				Require: []string{req},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected blacklisted image count: %d", n)
+	}
+}
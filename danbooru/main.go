@@ -1,16 +1,15 @@
 package danbooru
 
 import (
-	"context"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bakape/boorufetch"
 	"github.com/bakape/captchouli/v2/common"
@@ -18,9 +17,9 @@ import (
 )
 
 var (
-	cache = make(map[string]*cacheEntry)
-	mu    sync.Mutex
+	mu sync.Mutex
 
+	// Tags blacklisted by default
 	blacklisted = map[string]struct{}{
 		"photo":           {},
 		"monochrome":      {},
@@ -32,46 +31,18 @@ var (
 	}
 
 	errAllFetched = errors.New("all pages fetched")
-)
 
-type cacheEntry struct {
-	pages    map[int]struct{}
-	maxPages int // Estimate for maximum number of pages
-}
+	// Called with the MD5 hash of every image blacklisted while fetching and
+	// the tag it was fetched for, if set. Must be set before any fetches.
+	OnBlacklist func(md5 [16]byte, tag string)
+)
 
 // Fetch random matching file from Danbooru.
 // f can be nil, if no file is matched, even when err = nil.
 // Caller must close and remove temporary file after use.
 func Fetch(req common.FetchRequest) (f *os.File, image db.Image, err error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	pending, err := db.CountPending(req.Tag)
-	if err != nil {
-		return
-	}
-	allFetched := false
-	if pending < 3 {
-		err = tryFetchPage(req.Tag, req.Tag+" solo")
-		switch err {
-		case nil:
-		case errAllFetched:
-			err = nil
-			allFetched = true
-		default:
-			return
-		}
-	}
-
-	img, err := db.PopRandomPendingImage(req.Tag)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			if allFetched {
-				err = common.ErrNoMatch
-				return
-			}
-			err = nil
-		}
+	img, err := popPending(req)
+	if err != nil || img.URL == "" {
 		return
 	}
 
@@ -82,119 +53,181 @@ func Fetch(req common.FetchRequest) (f *os.File, image db.Image, err error) {
 		Tags:   img.Tags,
 	}
 
-	r, err := http.Get(img.URL)
+	// Download without holding the lock to allow concurrent fetches
+	r, err := get(img.URL)
 	if err != nil {
 		return
 	}
 	defer r.Body.Close()
 
+	// Skip images exceeding the download size limit, so they are not fetched
+	// again
+	max := maxDownloadSize()
+	tooLarge := func(size int64) error {
+		return blacklistImage(img.MD5, req.Tag, "too large",
+			"size", size, "max", max)
+	}
+	if r.ContentLength > max {
+		err = tooLarge(r.ContentLength)
+		return
+	}
+
 	f, err = ioutil.TempFile("", "")
 	if err != nil {
 		return
 	}
-	_, err = io.Copy(f, r.Body)
-	if err != nil {
+	n, err := io.Copy(f, io.LimitReader(r.Body, max+1))
+	if err != nil || n > max {
 		// Ignore any errors here. This cleanup need not succeed.
 		f.Close()
 		os.Remove(f.Name())
 		f = nil
 	}
+	if err == nil && n > max {
+		err = tooLarge(n)
+	}
+	return
+}
+
+// Blacklist an image fetched for tag, so it is not fetched again
+func blacklistImage(md5 [16]byte, tag, reason string,
+	keyvals ...interface{},
+) (err error) {
+	common.LogDebug("blacklisting image", append([]interface{}{"tag", tag,
+		"md5", hex.EncodeToString(md5[:]), "source", common.Danbooru,
+		"reason", reason}, keyvals...)...)
+	err = db.BlacklistImage(md5)
+	if err != nil {
+		return
+	}
+	if OnBlacklist != nil {
+		OnBlacklist(md5, tag)
+	}
+	return
+}
+
+func maxDownloadSize() int64 {
+	opts, _ := getOptions()
+	return opts.MaxDownloadSize
+}
+
+func pageCacheTTL() time.Duration {
+	opts, _ := getOptions()
+	return opts.PageCacheTTL
+}
+
+// Pop a random pending image for the requested tag, fetching more pending
+// images from Danbooru, if needed. img.URL is empty, if no image is currently
+// available.
+func popPending(req common.FetchRequest) (img db.PendingImage, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	pending, err := db.CountPending(req.Tag)
+	if err != nil {
+		return
+	}
+	allFetched := false
+	if pending < 3 {
+		err = tryFetchPage(req.Tag, req.Tag+" solo")
+		switch err {
+		case nil:
+		case errAllFetched:
+			err = nil
+			allFetched = true
+		default:
+			return
+		}
+	}
+
+	img, err = db.PopRandomPendingImage(req.Tag)
+	if err == sql.ErrNoRows {
+		if allFetched {
+			err = common.ErrNoMatch
+		} else {
+			err = nil
+		}
+	}
 	return
 }
 
 // Attempt to fetch a random page from Danbooru
 func tryFetchPage(requested, tags string) (err error) {
-	store := cache[tags]
-	if store == nil {
-		maxPages := 300
+	store, found, err := db.GetPageCache(tags, pageCacheTTL())
+	if err != nil {
+		return
+	}
+	if !found {
+		store.MaxPages = 300
 		if common.IsTest { // Reduce test duration
-			maxPages = 10
+			store.MaxPages = 10
 		}
-		store = &cacheEntry{
-			pages:    make(map[int]struct{}),
-			maxPages: maxPages,
+		err = db.SetMaxPages(tags, requested, store.MaxPages, true)
+		if err != nil {
+			return
 		}
-		cache[tags] = store
 	}
-	if store.maxPages == 0 {
+	if store.MaxPages == 0 {
 		err = common.ErrNoMatch
 		return
 	}
-	if len(store.pages) == store.maxPages {
+	if len(store.Pages) == store.MaxPages {
 		return errAllFetched
 	}
 
 	// Always dowload first page on fresh fetch
 	var page int
-	if len(store.pages) != 0 {
-		page = common.RandomInt(store.maxPages)
+	if len(store.Pages) != 0 {
+		page = common.FetchRand.Int(store.MaxPages)
 	} else {
 		page = 0
 	}
 
-	_, ok := store.pages[page]
+	_, ok := store.Pages[page]
 	if ok { // Cache hit
 		return
 	}
 
-	posts, err := boorufetch.FromDanbooru(tags, uint(page), 100)
+	start := time.Now()
+	posts, err := fetchPosts(tags, uint(page), 100)
 	if err != nil {
 		return
 	}
+	common.LogDebug("fetched page", "tag", requested, "query", tags,
+		"page", page, "posts", len(posts), "source", common.Danbooru,
+		"duration", time.Since(start))
 	if len(posts) == 0 {
-		if page == 0 {
-			err = common.ErrNoMatch
-			store.maxPages = 0 // Mark as invalid
+		// Empty page. Don't check pages past this one. They will also be empty.
+		// A query with an empty first page is marked as invalid.
+		err = db.SetMaxPages(tags, requested, page, false)
+		if err != nil {
 			return
 		}
-		// Empty page. Don't check pages past this one. They will also be empty.
-		store.maxPages = page
+		if page == 0 {
+			return common.ErrNoMatch
+		}
 		// Retry with a new random page
 		return tryFetchPage(requested, tags)
 	}
 
-	// Push applicable posts to pending image set
-	dst := make(chan error, 8)
-	src := make(chan boorufetch.Post, len(posts))
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	for _, p := range posts {
-		src <- p
-	}
-	cpus := runtime.NumCPU()
-	for i := 0; i < cpus; i++ {
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case p := <-src:
-					select {
-					case <-ctx.Done():
-						return
-					case dst <- processPost(requested, p):
-					}
-				}
-
-			}
-		}()
+	// Push applicable posts to pending image set. Posts carry all their data,
+	// so processing them needs no network calls and is done sequentially.
+	r, err := rulesFor(requested)
+	if err != nil {
+		return
 	}
-	for i := 0; i < len(posts); i++ {
-		err = <-dst
+	for i := range posts {
+		err = processPost(requested, &posts[i], r)
 		if err != nil {
 			return
 		}
 	}
 
 	// Set page as seen
-	store.pages[page] = struct{}{}
-
-	return
+	return db.SetPageFetched(tags, page)
 }
 
-func processPost(requested string, p boorufetch.Post,
+func processPost(requested string, p *post, r rules,
 ) (err error) {
 	img := db.PendingImage{TargetTag: requested}
 	img.MD5, err = p.MD5()
@@ -213,8 +246,8 @@ func processPost(requested string, p boorufetch.Post,
 		return
 	}
 
-	blacklist := func() error {
-		return db.BlacklistImage(img.MD5)
+	blacklist := func(reason string) error {
+		return blacklistImage(img.MD5, requested, reason)
 	}
 
 	// File must be a still image
@@ -229,7 +262,7 @@ func processPost(requested string, p boorufetch.Post,
 		}
 	}
 	if !valid {
-		return blacklist()
+		return blacklist("not a still image")
 	}
 
 	// Rating and tag fetches might need a network fetch, so do these later
@@ -249,14 +282,14 @@ func processPost(requested string, p boorufetch.Post,
 		// Allow only images with 1 character in them
 		if t.Type == boorufetch.Character {
 			if hasChar {
-				return blacklist()
+				return blacklist("multiple characters")
 			}
 			hasChar = true
 		}
 
 		// Ensure tags do not contain any of the blacklisted tags
-		if _, ok := blacklisted[t.Tag]; ok {
-			return blacklist()
+		if _, ok := r.blacklist[strings.ToLower(t.Tag)]; ok {
+			return blacklist("blacklisted tag " + t.Tag)
 		}
 
 		// Ensure tags contain solo
@@ -269,8 +302,23 @@ func processPost(requested string, p boorufetch.Post,
 			containsRequested = strings.ToLower(t.Tag) == requested
 		}
 	}
-	if !containsRequested || !hasSolo {
-		return blacklist()
+	if !containsRequested {
+		return blacklist("missing requested tag")
+	}
+	if !hasSolo {
+		return blacklist("not solo")
+	}
+	for _, req := range r.require {
+		found := false
+		for _, t := range booruTags {
+			if strings.ToLower(t.Tag) == req {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return blacklist("missing required tag " + req)
+		}
 	}
 
 	img.Tags = make([]string, 0, len(booruTags))
@@ -4,21 +4,51 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/bakape/captchouli/v2/common"
 	"github.com/bakape/captchouli/v2/db"
+	"github.com/bakape/captchouli/v2/test_utils"
 	"github.com/olekukonko/tablewriter"
 )
 
+var (
+	booru *test_utils.FakeDanbooru
+
+	// Client settings pointing to booru
+	testOptions Options
+)
+
 func TestMain(t *testing.M) {
 	db.OpenForTests()
-	os.Exit(t.Run())
+
+	img, err := ioutil.ReadFile(filepath.Join("..", "testdata", "sample.jpg"))
+	if err != nil {
+		panic(err)
+	}
+	booru = test_utils.NewFakeDanbooru(img)
+	testOptions = Options{
+		BaseURL:   booru.URL,
+		RateLimit: 1000,
+	}
+	err = Configure(testOptions)
+	if err != nil {
+		panic(err)
+	}
+
+	code := t.Run()
+	booru.Close()
+	os.Exit(code)
 }
 
 func TestFetch(t *testing.T) {
-	testFetches(t, "sakura_kyouko")
+	tag := test_utils.RandomTag()
+	booru.AddTag(tag, 5)
+	testFetches(t, tag)
 }
 
 func testFetches(t *testing.T, tag string) {
@@ -37,19 +67,20 @@ func testFetches(t *testing.T, tag string) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if f != nil {
-		err = os.Remove(f.Name())
-		if err != nil {
-			t.Fatal(err)
-		}
-		err = f.Close()
-		if err != nil {
-			t.Fatal(err)
-		}
-		w.Append([]string{img.Rating.String(),
-			hex.EncodeToString(img.MD5[:]),
-			fmt.Sprint(img.Tags)})
+	if f == nil {
+		t.Fatal("no image fetched")
 	}
+	err = os.Remove(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append([]string{img.Rating.String(),
+		hex.EncodeToString(img.MD5[:]),
+		fmt.Sprint(img.Tags)})
 
 	w.Render()
 	t.Logf("\n%s\n", buf.String())
@@ -57,7 +88,7 @@ func testFetches(t *testing.T, tag string) {
 
 func TestNoMatch(t *testing.T) {
 	_, _, err := Fetch(common.FetchRequest{
-		Tag: "sakura_kyouko_dsadsdadsadsad",
+		Tag: test_utils.RandomTag(),
 	})
 	if err != common.ErrNoMatch {
 		t.Fatal(err)
@@ -65,5 +96,92 @@ func TestNoMatch(t *testing.T) {
 }
 
 func TestOnlyOnePage(t *testing.T) {
-	testFetches(t, "symphogear_live")
+	tag := test_utils.RandomTag()
+	booru.AddTag(tag, 1)
+	testFetches(t, tag)
+}
+
+func TestResolveTag(t *testing.T) {
+	old, renamed := test_utils.RandomTag(), test_utils.RandomTag()
+	booru.AddAlias(old, renamed)
+	booru.AddTag(renamed, 3)
+
+	tag, err := ResolveTag(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != renamed {
+		t.Fatalf("alias not resolved: %s", tag)
+	}
+	testFetches(t, tag)
+
+	unchanged := test_utils.RandomTag()
+	tag, err = ResolveTag(unchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != unchanged {
+		t.Fatalf("tag resolved without alias: %s", tag)
+	}
+}
+
+// Record images passed to OnBlacklist until the returned function is called
+func recordBlacklisted() (blacklisted map[[16]byte]string, stop func()) {
+	var mu sync.Mutex
+	blacklisted = make(map[[16]byte]string)
+	OnBlacklist = func(md5 [16]byte, tag string) {
+		mu.Lock()
+		defer mu.Unlock()
+		blacklisted[md5] = tag
+	}
+	return blacklisted, func() {
+		OnBlacklist = nil
+	}
+}
+
+func TestBlacklistTooLarge(t *testing.T) {
+	tag := test_utils.RandomTag()
+	booru.AddTag(tag, 1)
+	opts := testOptions
+	opts.MaxDownloadSize = 1
+	Configure(opts)
+	defer Configure(testOptions)
+	blacklisted, stop := recordBlacklisted()
+	defer stop()
+
+	f, img, err := Fetch(common.FetchRequest{Tag: tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Fatal("too large image fetched")
+	}
+	if blacklisted[img.MD5] != tag {
+		t.Fatalf("image not reported as blacklisted: %v", blacklisted)
+	}
+}
+
+func TestBlacklistFiltered(t *testing.T) {
+	tag := test_utils.RandomTag()
+	booru.AddTag(tag, 2)
+	SetContentFilter(common.ContentFilter{Blacklist: []string{"1girl"}})
+	defer SetContentFilter(common.ContentFilter{})
+	blacklisted, stop := recordBlacklisted()
+	defer stop()
+
+	f, _, err := Fetch(common.FetchRequest{Tag: tag})
+	if err != nil && err != common.ErrNoMatch {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Fatal("blacklisted image fetched")
+	}
+	if len(blacklisted) != 2 {
+		t.Fatalf("unexpected blacklisted images: %v", blacklisted)
+	}
+	for _, tg := range blacklisted {
+		if tg != tag {
+			t.Fatalf("unexpected tag: %s", tg)
+		}
+	}
 }
@@ -0,0 +1,82 @@
+package danbooru
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bakape/boorufetch"
+)
+
+// Post decoded from the Danbooru posts API
+type post struct {
+	Hash      string            `json:"md5"`
+	URL       string            `json:"file_url"`
+	Rating_   boorufetch.Rating `json:"rating"`
+	General   string            `json:"tag_string_general"`
+	Character string            `json:"tag_string_character"`
+	Copyright string            `json:"tag_string_copyright"`
+	Artist    string            `json:"tag_string_artist"`
+	Meta      string            `json:"tag_string_meta"`
+}
+
+func (p *post) MD5() ([16]byte, error) {
+	return boorufetch.DecodeMD5(p.Hash)
+}
+
+func (p *post) FileURL() string {
+	return p.URL
+}
+
+func (p *post) Rating() (boorufetch.Rating, error) {
+	return p.Rating_, nil
+}
+
+// Return deduplicated tags of all categories
+func (p *post) Tags() (tags []boorufetch.Tag, err error) {
+	seen := make(map[string]struct{}, 64)
+	for _, c := range [...]struct {
+		typ boorufetch.TagType
+		s   string
+	}{
+		{boorufetch.Author, p.Artist},
+		{boorufetch.Character, p.Character},
+		{boorufetch.Series, p.Copyright},
+		{boorufetch.Undefined, p.General},
+		{boorufetch.Meta, p.Meta},
+	} {
+		for _, t := range strings.Fields(c.s) {
+			if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			tags = append(tags, boorufetch.Tag{
+				Type: c.typ,
+				Tag:  t,
+			})
+		}
+	}
+	return
+}
+
+// Fetch a page of posts matching the tag query
+func fetchPosts(query string, page, limit uint) (posts []post, err error) {
+	q := url.Values{
+		"tags":  {query},
+		"page":  {strconv.FormatUint(uint64(page), 10)},
+		"limit": {strconv.FormatUint(uint64(limit), 10)},
+	}
+	r, err := get(baseURL() + "/posts.json?" + q.Encode())
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+
+	err = json.NewDecoder(r.Body).Decode(&posts)
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package danbooru
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+)
+
+// Alias or implication relationship between two tags
+type tagRelation struct {
+	Antecedent string `json:"antecedent_name"`
+	Consequent string `json:"consequent_name"`
+}
+
+// Resolve the current name of a tag on Danbooru and record it and the tags
+// implying it in the local alias table. If Danbooru can not be reached, the
+// name recorded in the local alias table, if any, is returned along with the
+// error.
+func ResolveTag(tag string) (resolved string, err error) {
+	tag = strings.ToLower(tag)
+	resolved, _, err = db.ResolveTagAlias(tag)
+	if err != nil {
+		return
+	}
+
+	aliases, err := fetchRelations("tag_aliases", "antecedent_name", tag)
+	if err != nil {
+		return
+	}
+	consequent := tag
+	for _, a := range aliases {
+		consequent = strings.ToLower(a.Consequent)
+	}
+	if consequent != tag {
+		common.LogInfo("tag aliased", "tag", tag, "alias", consequent,
+			"source", common.Danbooru)
+	}
+	err = db.SetTagAlias(tag, consequent)
+	if err != nil {
+		return
+	}
+	resolved = consequent
+
+	implications, err := fetchRelations("tag_implications", "consequent_name",
+		resolved)
+	if err != nil {
+		return
+	}
+	antecedents := make([]string, 0, len(implications))
+	for _, i := range implications {
+		antecedents = append(antecedents, i.Antecedent)
+	}
+	err = db.SetTagImplications(resolved, antecedents)
+	return
+}
+
+// Fetch all active tag relations of kind, where the field matches tag
+func fetchRelations(kind, field, tag string) (rels []tagRelation, err error) {
+	q := url.Values{
+		"search[" + field + "]": {tag},
+		"search[status]":        {"active"},
+		"limit":                 {"1000"},
+	}
+	r, err := get(baseURL() + "/" + kind + ".json?" + q.Encode())
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+	err = json.NewDecoder(r.Body).Decode(&rels)
+	return
+}
@@ -3,7 +3,6 @@ package db
 import (
 	crypto "crypto/rand"
 	"database/sql"
-	"math/rand"
 	"strings"
 
 	"github.com/Masterminds/squirrel"
@@ -15,26 +14,27 @@ import (
 type Filters struct {
 	common.FetchRequest
 	Explicitness []boorufetch.Rating
+	Distractors  common.Distractors
 }
 
 // Generate a new captcha and return its ID and image list in order
 func GenerateCaptcha(f Filters) (id [64]byte, images [9][16]byte, err error) {
 	f.Tag = strings.ToLower(f.Tag)
 
-	buf := make([]byte, 16)
-	matchedCount, err := getMatchingImages(f, &images, &buf)
+	var sel selection
+	matchedCount, err := getMatchingImages(f, &images, &sel)
 	if err != nil {
 		return
 	}
 	matched := make([][16]byte, matchedCount)
 	copy(matched, images[:])
 
-	err = getNonMatchingImages(f, 9-matchedCount, &images, &buf)
+	err = getNonMatchingImages(f, 9-matchedCount, &images, &sel)
 	if err != nil {
 		return
 	}
 
-	rand.New(common.CryptoSource).Shuffle(9, func(i, j int) {
+	common.CaptchaRand.Shuffle(9, func(i, j int) {
 		images[i], images[j] = images[j], images[i]
 	})
 
@@ -60,16 +60,16 @@ func GenerateCaptcha(f Filters) (id [64]byte, images [9][16]byte, err error) {
 	defer dbMu.Unlock()
 
 	_, err = sq.Insert("captchas").
-		Columns("id", "solution").
-		Values(id[:], solution[:]).
+		Columns("id", "solution", "tag").
+		Values(id[:], solution[:], f.Tag).
 		Exec()
 	return
 }
 
-func getMatchingImages(f Filters, images *[9][16]byte, buf *[]byte,
+func getMatchingImages(f Filters, images *[9][16]byte, sel *selection,
 ) (n int, err error) {
-	n = common.RandomInt(2) + 2
-	q := sq.Select("hash").
+	n = common.CaptchaRand.Int(2) + 2
+	q := sq.Select("hash", "source_hash", "phash", "0 as rank").
 		From("image_tags").
 		Join("images on images.id = image_id").
 		Where(squirrel.Eq{
@@ -77,58 +77,219 @@ func getMatchingImages(f Filters, images *[9][16]byte, buf *[]byte,
 			"source":    common.Danbooru,
 			"blacklist": false,
 			"rating":    f.Explicitness,
-		}).
-		OrderBy("random()").
-		Limit(uint64(n))
-	err = queryHashes(q, 0, images, buf)
+		})
+	err = sel.pick(q, n, 0, images)
 	return
 }
 
-func getNonMatchingImages(f Filters, n int, images *[9][16]byte, buf *[]byte,
+func getNonMatchingImages(f Filters, n int, images *[9][16]byte,
+	sel *selection,
 ) (err error) {
-	q := sq.Select("hash").
+	excluded, err := f.excluded()
+	if err != nil {
+		return
+	}
+	q := sq.Select("hash", "source_hash", "phash").
 		From("images").
 		Where(
-			`not exists (
-				select 1
-				from image_tags
-				where image_id = images.id and tag = ?)`,
-			f.Tag).
+			squirrel.Expr(
+				`not exists (
+					select 1
+					from image_tags
+					where image_id = images.id and tag in (`+
+					squirrel.Placeholders(len(excluded))+`))`,
+				excluded...,
+			)).
 		Where(squirrel.Eq{
 			"blacklist": false,
 			"rating":    f.Explicitness,
-		}).
-		OrderBy("random()").
-		Limit(uint64(n))
-	return queryHashes(q, 9-n, images, buf)
+		})
+	if f.Distractors.MinTags > 0 {
+		q = q.Where(
+			`(select count(*) from image_tags where image_id = images.id) >= ?`,
+			f.Distractors.MinTags)
+	}
+
+	if f.Distractors.Strategy == common.SimilarDistractors &&
+		len(f.Distractors.Tags) != 0 {
+		q, err = rankBySharedTags(q, f.Distractors.Tags, images[:9-n])
+		if err != nil {
+			return
+		}
+	} else {
+		q = q.Column("0 as rank")
+	}
+	return sel.pick(q, n, 9-n, images)
 }
 
-func queryHashes(q squirrel.SelectBuilder, i int, images *[9][16]byte,
-	buf *[]byte,
-) (err error) {
-	dbMu.RLock()
-	defer dbMu.RUnlock()
+// Return the captcha tag, all tags sharing an exclusion group with it and
+// their related tags
+func (f Filters) excluded() (tags []interface{}, err error) {
+	group := []string{f.Tag}
+	for _, g := range f.Distractors.Exclude {
+		for _, t := range g {
+			if strings.ToLower(t) != f.Tag {
+				continue
+			}
+			for _, t := range g {
+				if t = strings.ToLower(t); t != f.Tag {
+					group = append(group, t)
+				}
+			}
+			break
+		}
+	}
+
+	related, err := relatedTags(group)
+	if err != nil {
+		return
+	}
+	tags = make([]interface{}, len(related))
+	for i, t := range related {
+		tags[i] = t
+	}
+	return
+}
 
-	r, err := q.Query()
+// Rank images by the number of tags matching any of the patterns they share
+// with the matched images
+func rankBySharedTags(q squirrel.SelectBuilder, patterns []string,
+	matched [][16]byte,
+) (ranked squirrel.SelectBuilder, err error) {
+	hashes := make([]interface{}, len(matched))
+	for i := range matched {
+		hashes[i] = matched[i][:]
+	}
+	var globs squirrel.Or
+	for _, p := range patterns {
+		globs = append(globs, squirrel.Expr("m.tag glob ?", p))
+	}
+	shared, args, err := sq.Select("m.tag").
+		From("image_tags as m").
+		Join("images as mi on mi.id = m.image_id").
+		Where(squirrel.Eq{"mi.hash": hashes}).
+		Where(globs).
+		ToSql()
 	if err != nil {
 		return
 	}
-	defer r.Close()
+	ranked = q.Column(
+		squirrel.Expr(
+			`(select count(*)
+			from image_tags as s
+			where s.image_id = images.id and s.tag in (`+shared+`)) as rank`,
+			args...,
+		),
+	)
+	return
+}
+
+// Perceptual hashes of the images already selected for a captcha
+type selection []sql.NullInt64
 
-	for r.Next() {
-		err = r.Scan(buf)
+// Return, if phash is similar to any already selected image
+func (s selection) similar(phash sql.NullInt64) bool {
+	if !phash.Valid {
+		return false
+	}
+	for _, p := range s {
+		if p.Valid && IsDuplicate(uint64(p.Int64), uint64(phash.Int64)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select n random crops from q into images starting at index i. Each crop is
+// from a different source image and visually similar images are avoided, if
+// enough candidates are available. q must select the hash, source_hash, phash
+// and rank columns. Candidates with a higher rank are preferred. Returns
+// common.ErrNotEnoughImages, if there are fewer than n candidates.
+func (s *selection) pick(q squirrel.SelectBuilder, n, i int,
+	images *[9][16]byte,
+) (err error) {
+	type candidate struct {
+		hash  []byte
+		phash sql.NullInt64
+	}
+
+	// Order crops by a random affine permutation of their IDs modulo a prime
+	// instead of random(), so the order is reproducible with a seeded random
+	// source
+	const p = 2147483647
+	seed := common.CaptchaRand.Int63()
+	a, b := 1+seed%(p-1), seed/p%p
+
+	var candidates []candidate
+	err = func() (err error) {
+		dbMu.RLock()
+		defer dbMu.RUnlock()
+
+		// SQLite takes bare columns from the row matching min() in aggregate
+		// queries, which selects a random crop of each source
+		r, err := sq.Select("hash", "phash").
+			FromSelect(
+				q.Column(squirrel.Expr("min((images.id * ? + ?) % ?) as pick",
+					a, b, p)).
+					GroupBy("source_hash"),
+				"crops").
+			OrderBy("rank desc", "pick").
+			Limit(uint64(n * 3)).
+			Query()
 		if err != nil {
 			return
 		}
-		copy(images[i][:], *buf)
+		defer r.Close()
+
+		for r.Next() {
+			var c candidate
+			err = r.Scan(&c.hash, &c.phash)
+			if err != nil {
+				return
+			}
+			candidates = append(candidates, c)
+		}
+		return r.Err()
+	}()
+	if err != nil {
+		return
+	}
+
+	add := func(c candidate) {
+		copy(images[i][:], c.hash)
 		i++
+		n--
+		*s = append(*s, c.phash)
+	}
+
+	// Fall back to similar images only, if there are not enough others
+	var similar []candidate
+	for _, c := range candidates {
+		if n == 0 {
+			return
+		}
+		if s.similar(c.phash) {
+			similar = append(similar, c)
+		} else {
+			add(c)
+		}
+	}
+	for _, c := range similar {
+		if n == 0 {
+			return
+		}
+		add(c)
+	}
+	if n != 0 {
+		err = common.ErrNotEnoughImages
 	}
-	err = r.Err()
 	return
 }
 
-// Check, if a solution to a captcha is valid
-func CheckSolution(id [64]byte, solution []byte) (solved bool, err error) {
+// Check, if a solution to a captcha is valid. Also returns the tag the captcha
+// was generated for, if the captcha exists.
+func CheckSolution(id [64]byte, solution []byte,
+) (solved bool, tag string, err error) {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
@@ -137,12 +298,12 @@ func CheckSolution(id [64]byte, solution []byte) (solved bool, err error) {
 			correct []byte
 		)
 		err = sq.
-			Select("solution").
+			Select("solution", "tag").
 			From("captchas").
 			Where("id = ? and status = 0", id[:]).
 			RunWith(tx).
 			QueryRow().
-			Scan(&correct)
+			Scan(&correct, &tag)
 		switch err {
 		case nil:
 		case sql.ErrNoRows:
@@ -199,22 +360,34 @@ func GetSolution(id [64]byte) (solution []byte, err error) {
 	return
 }
 
-// Return, if captcha exists and is solved. The captcha is deleted on a
-// successful check to prevent replayagain attacks.
-func IsSolved(id [64]byte) (is bool, err error) {
+// Return, if captcha exists and is solved, and the tag the captcha was
+// generated for. The captcha is deleted on a successful check to prevent
+// replayagain attacks.
+func IsSolved(id [64]byte) (is bool, tag string, err error) {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
-	res, err := sq.Delete("captchas").
-		Where("id = ? and status = 1", id[:]).
-		Exec()
-	if err != nil {
-		return
-	}
-	n, err := res.RowsAffected()
-	if err != nil {
+	err = InTransaction(func(tx *sql.Tx) (err error) {
+		err = sq.Select("tag").
+			From("captchas").
+			Where("id = ? and status = 1", id[:]).
+			RunWith(tx).
+			QueryRow().
+			Scan(&tag)
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			return nil
+		default:
+			return
+		}
+
+		is = true
+		_, err = sq.Delete("captchas").
+			Where("id = ?", id[:]).
+			RunWith(tx).
+			Exec()
 		return
-	}
-	is = n != 0
+	})
 	return
 }
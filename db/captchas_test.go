@@ -0,0 +1,256 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	mRand "math/rand"
+	"strings"
+	"testing"
+
+	"github.com/bakape/boorufetch"
+	"github.com/bakape/captchouli/v2/common"
+)
+
+// Insert n images with random hashes and the passed tags plus a random one
+func insertTagged(t *testing.T, n int, tags ...string) (hashes [][16]byte) {
+	t.Helper()
+	return insertRated(t, boorufetch.Questionable, n, tags...)
+}
+
+// Like insertTagged, but with the passed rating
+func insertRated(t *testing.T, rating boorufetch.Rating, n int,
+	tags ...string,
+) (hashes [][16]byte) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		img := Image{
+			Rating: rating,
+			Source: common.Danbooru,
+		}
+		_, err := rand.Read(img.MD5[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.Tags = append([]string{hex.EncodeToString(img.MD5[:])}, tags...)
+		img.Crops = []Crop{{Hash: img.MD5}}
+		err = InsertImage(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, img.MD5)
+	}
+	return
+}
+
+func TestSimilarDistractors(t *testing.T) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := hex.EncodeToString(buf[:])
+	hair := tag + "_hair"
+
+	insertTagged(t, 3, tag, hair)
+	similar := make(map[[16]byte]bool)
+	for _, h := range insertTagged(t, 7, hair) {
+		similar[h] = true
+	}
+	insertTagged(t, 7, tag+"_eyes")
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.Questionable},
+		Distractors: common.Distractors{
+			Strategy: common.SimilarDistractors,
+			Tags:     []string{"*_hair"},
+		},
+	}
+	f.Tag = tag
+	for i := 0; i < 5; i++ {
+		var (
+			images [9][16]byte
+			sel    selection
+		)
+		matched, err := getMatchingImages(f, &images, &sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = getNonMatchingImages(f, 9-matched, &images, &sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range images[matched:] {
+			if !similar[h] {
+				t.Fatalf("distractor without shared tags selected: %x", h)
+			}
+		}
+	}
+}
+
+func TestExcludedDistractors(t *testing.T) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := hex.EncodeToString(buf[:])
+	alias := tag + "_alias"
+
+	insertTagged(t, 3, tag, tag+"_a", tag+"_b")
+	rejected := make(map[[16]byte]bool)
+	for _, h := range insertTagged(t, 7, alias, tag+"_a") {
+		rejected[h] = true
+	}
+	for _, h := range insertTagged(t, 7, tag+"_a") {
+		rejected[h] = true
+	}
+	insertTagged(t, 7, tag+"_a", tag+"_b")
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.Questionable},
+		Distractors: common.Distractors{
+			Exclude: [][]string{
+				{"unrelated", "tags"},
+				{strings.ToUpper(alias), tag},
+			},
+			MinTags: 3,
+		},
+	}
+	f.Tag = tag
+	for i := 0; i < 5; i++ {
+		var (
+			images [9][16]byte
+			sel    selection
+		)
+		err = getNonMatchingImages(f, 9, &images, &sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range images {
+			if rejected[h] {
+				t.Fatalf("excluded distractor selected: %x", h)
+			}
+		}
+	}
+}
+
+func TestRelatedTagsExcluded(t *testing.T) {
+	tag, parent, alias := randomTag(t), randomTag(t), randomTag(t)
+	err := SetTagImplications(parent, []string{tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetTagAlias(alias, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insertTagged(t, 3, tag, "solo")
+	rejected := make(map[[16]byte]bool)
+	for _, h := range insertTagged(t, 7, parent, "solo") {
+		rejected[h] = true
+	}
+	insertTagged(t, 9, "solo", randomTag(t))
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.Questionable},
+		Distractors: common.Distractors{
+			MinTags: 2,
+		},
+	}
+	f.Tag = tag
+	excluded, err := f.excluded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [...]string{tag, parent, alias} {
+		found := false
+		for _, e := range excluded {
+			if e == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("related tag not excluded: %s", want)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		var (
+			images [9][16]byte
+			sel    selection
+		)
+		err = getNonMatchingImages(f, 9, &images, &sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range images {
+			if rejected[h] {
+				t.Fatalf("implied tag distractor selected: %x", h)
+			}
+		}
+	}
+}
+
+func TestNotEnoughImages(t *testing.T) {
+	tag := randomTag(t)
+	insertTagged(t, 4, tag)
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.Questionable},
+		Distractors: common.Distractors{
+			MinTags: 1000,
+		},
+	}
+	f.Tag = tag
+	_, _, err := GenerateCaptcha(f)
+	if err != common.ErrNotEnoughImages {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReproducibleCaptchas(t *testing.T) {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := hex.EncodeToString(buf[:])
+
+	// Explicit images are not inserted by any other test, so the distractor
+	// pool does not change between the generated captchas
+	insertRated(t, boorufetch.Explicit, 6, tag)
+	insertRated(t, boorufetch.Explicit, 12, tag+"_other")
+	defer common.SetRandomSource(nil)
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.Explicit},
+	}
+	f.Tag = tag
+	generate := func() (images [9][16]byte, solution []byte) {
+		common.SetRandomSource(mRand.NewSource(1))
+		id, images, err := GenerateCaptcha(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		solution, err = GetSolution(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	images, solution := generate()
+	for i := 0; i < 3; i++ {
+		im, sol := generate()
+		if im != images {
+			t.Fatalf("images differ: %x != %x", im, images)
+		}
+		if !bytes.Equal(sol, solution) {
+			t.Fatalf("solutions differ: %v != %v", sol, solution)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build cgo
+// +build cgo
+
+package db
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite driver linked into builds with cgo
+const defaultDriver = "sqlite3"
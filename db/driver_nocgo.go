@@ -0,0 +1,11 @@
+//go:build !cgo
+// +build !cgo
+
+package db
+
+import (
+	_ "modernc.org/sqlite"
+)
+
+// Pure-Go SQLite driver linked into builds without cgo
+const defaultDriver = "sqlite"
@@ -2,48 +2,105 @@ package db
 
 import (
 	"database/sql"
+	"math/bits"
 	"strings"
+	"sync/atomic"
 
 	"github.com/Masterminds/squirrel"
 	"github.com/bakape/boorufetch"
 	"github.com/bakape/captchouli/v2/common"
 )
 
+// Source image downloaded from a booru
 type Image struct {
 	Rating boorufetch.Rating
 	Source common.DataSource
 	MD5    [16]byte
 	Tags   []string
+
+	// Thumbnails cropped from the image. Each crop is a separate pool entry.
+	// If empty, a single crop identified by MD5 is assumed.
+	Crops []Crop
+}
+
+// Thumbnail cropped from a source image
+type Crop struct {
+	// Identifies the thumbnail. See common.CropHash.
+	Hash    [16]byte
+	Quality common.Quality
+
+	// Perceptual hash of the thumbnail. Only valid, if HasPHash is set.
+	PHash    uint64
+	HasPHash bool
+}
+
+// Maximum Hamming distance between the perceptual hashes of near-duplicate
+// images. Negative values disable near-duplicate detection.
+var duplicateDistance int32 = 10
+
+// Set maximum Hamming distance between the perceptual hashes of
+// near-duplicate images. Negative values disable near-duplicate detection.
+func SetDuplicateDistance(d int) {
+	atomic.StoreInt32(&duplicateDistance, int32(d))
+}
+
+// Return, if two perceptual hashes belong to near-duplicate images
+func IsDuplicate(a, b uint64) bool {
+	max := int(atomic.LoadInt32(&duplicateDistance))
+	return max >= 0 && bits.OnesCount64(a^b) <= max
 }
 
 // Return, if file is not already registered in the DB as valid thumbnail or in
 // a blacklist
-func IsInDatabase(md5 [16]byte) (bool, error) {
-	return imageExists("images", md5)
+func IsInDatabase(md5 [16]byte) (exists bool, err error) {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	err = sq.Select("1").
+		From("images").
+		Where("source_hash = ?", md5[:]).
+		Limit(1).
+		Scan(&exists)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// Return, if a crop is already registered in the DB as valid thumbnail or in
+// a blacklist
+func IsCropInDatabase(hash [16]byte) (exists bool, err error) {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	err = sq.Select("1").
+		From("images").
+		Where("hash = ?", hash[:]).
+		Limit(1).
+		Scan(&exists)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return
 }
 
-// Write image to database
+// Write image and all its crops to database
 func InsertImage(img Image) (err error) {
 	if len(img.Tags) == 0 {
 		return BlacklistImage(img.MD5)
 	}
 
 	lowercaseTags(img.Tags)
+	crops := img.Crops
+	if len(crops) == 0 {
+		crops = []Crop{{Hash: img.MD5}}
+	}
 
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
-	return InTransaction(func(tx *sql.Tx) (err error) {
-		r, err := sq.
-			Insert("images").
-			Columns("hash", "rating").
-			Values(img.MD5[:], img.Rating).
-			RunWith(tx).
-			Exec()
-		if err != nil {
-			return
-		}
-		id, err := r.LastInsertId()
+	err = InTransaction(func(tx *sql.Tx) (err error) {
+		tags, err := resolveTags(tx, img.Tags)
 		if err != nil {
 			return
 		}
@@ -54,14 +111,283 @@ func InsertImage(img Image) (err error) {
 		if err != nil {
 			return
 		}
-		for _, t := range img.Tags {
-			_, err = q.Exec(id, t, img.Source)
+		defer q.Close()
+
+		for _, c := range crops {
+			var r sql.Result
+			r, err = sq.
+				Insert("images").
+				Columns("hash", "source_hash", "rating", "face_size",
+					"relative_size", "sharpness", "contrast", "confidence",
+					"aspect", "phash").
+				Values(c.Hash[:], img.MD5[:], img.Rating, c.Quality.FaceSize,
+					c.Quality.RelativeSize, c.Quality.Sharpness,
+					c.Quality.Contrast, c.Quality.Confidence,
+					c.Quality.Aspect, c.phashValue()).
+				RunWith(tx).
+				Exec()
 			if err != nil {
 				return
 			}
+			var id int64
+			id, err = r.LastInsertId()
+			if err != nil {
+				return
+			}
+
+			for _, t := range tags {
+				_, err = q.Exec(id, t, img.Source)
+				if err != nil {
+					return
+				}
+			}
 		}
 		return
 	})
+	if err != nil {
+		return
+	}
+	for _, c := range crops {
+		if c.HasPHash {
+			setIndexedPHash(c.Hash, c.PHash)
+		}
+	}
+	return
+}
+
+// Crops inserted without a perceptual hash store null
+func (c Crop) phashValue() interface{} {
+	if !c.HasPHash {
+		return nil
+	}
+	// SQLite integers are signed
+	return int64(c.PHash)
+}
+
+// Return the hash of a pool image visually similar to an image with the
+// passed perceptual hash, if any
+func FindDuplicate(phash uint64) (hash [16]byte, found bool, err error) {
+	if atomic.LoadInt32(&duplicateDistance) < 0 {
+		return
+	}
+
+	for {
+		var loaded bool
+		hash, found, loaded = findIndexedDuplicate(phash)
+		if loaded {
+			return
+		}
+		err = func() error {
+			dbMu.RLock()
+			defer dbMu.RUnlock()
+			return loadPHashIndex()
+		}()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Return hashes of all pool images without a perceptual hash
+func GetUnhashedImages() (hashes [][16]byte, err error) {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	r, err := sq.Select("hash").
+		From("images").
+		Where("phash is null and blacklist = false").
+		Query()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	var buf []byte
+	for r.Next() {
+		err = r.Scan(&buf)
+		if err != nil {
+			return
+		}
+		var h [16]byte
+		copy(h[:], buf)
+		hashes = append(hashes, h)
+	}
+	err = r.Err()
+	return
+}
+
+// Set the perceptual hash of a pool image
+func SetPerceptualHash(hash [16]byte, phash uint64) (err error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	_, err = sq.Update("images").
+		Set("phash", int64(phash)).
+		Where("hash = ?", hash[:]).
+		Exec()
+	if err != nil {
+		return
+	}
+	setIndexedPHash(hash, phash)
+	return
+}
+
+// Return stored quality metrics of a non-blacklisted crop. Images inserted
+// before quality metrics were recorded have all metrics set to zero.
+func GetQuality(md5 [16]byte) (q common.Quality, err error) {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	var stored storedQuality
+	err = sq.
+		Select(qualityColumns...).
+		From("images").
+		Where(squirrel.Eq{
+			"hash":      md5[:],
+			"blacklist": false,
+		}).
+		QueryRow().
+		Scan(stored.dest()...)
+	if err != nil {
+		return
+	}
+	q = stored.value()
+	return
+}
+
+// Columns storing the quality metrics of a crop
+var qualityColumns = []string{"face_size", "relative_size", "sharpness",
+	"contrast", "confidence", "aspect"}
+
+// Quality metrics as stored in qualityColumns. Images inserted before quality
+// metrics were recorded store null.
+type storedQuality struct {
+	faceSize                               sql.NullInt64
+	relSize, sharp, contrast, conf, aspect sql.NullFloat64
+}
+
+// Return scan destinations for qualityColumns
+func (q *storedQuality) dest() []interface{} {
+	return []interface{}{&q.faceSize, &q.relSize, &q.sharp, &q.contrast,
+		&q.conf, &q.aspect}
+}
+
+// Return metrics with null values set to zero
+func (q storedQuality) value() common.Quality {
+	return common.Quality{
+		FaceSize:     int(q.faceSize.Int64),
+		RelativeSize: q.relSize.Float64,
+		Sharpness:    q.sharp.Float64,
+		Contrast:     q.contrast.Float64,
+		Confidence:   q.conf.Float64,
+		Aspect:       q.aspect.Float64,
+	}
+}
+
+// Return all non-blacklisted source images tagged with any of tags with their
+// crops. If tags is empty, all non-blacklisted images are returned.
+func GetImages(tags []string) (images []Image, err error) {
+	q := sq.Select(append([]string{"id", "hash", "source_hash", "rating",
+		"phash"}, qualityColumns...)...).
+		From("images").
+		Where("blacklist = false").
+		OrderBy("id")
+	if len(tags) != 0 {
+		args := make([]interface{}, len(tags))
+		for i, t := range tags {
+			args[i] = strings.ToLower(t)
+		}
+		q = q.Where(
+			squirrel.Expr(
+				`exists (
+					select 1
+					from image_tags
+					where image_id = images.id and tag in (`+
+					squirrel.Placeholders(len(args))+`))`,
+				args...,
+			))
+	}
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	// ID of the first crop of each image
+	var ids []int64
+	err = func() (err error) {
+		r, err := q.Query()
+		if err != nil {
+			return
+		}
+		defer r.Close()
+
+		bySource := make(map[string]int)
+		for r.Next() {
+			var (
+				id           int64
+				hash, source []byte
+				rating       boorufetch.Rating
+				phash        sql.NullInt64
+				stored       storedQuality
+			)
+			err = r.Scan(append(
+				[]interface{}{&id, &hash, &source, &rating, &phash},
+				stored.dest()...)...)
+			if err != nil {
+				return
+			}
+			c := Crop{
+				Quality:  stored.value(),
+				PHash:    uint64(phash.Int64),
+				HasPHash: phash.Valid,
+			}
+			copy(c.Hash[:], hash)
+
+			i, ok := bySource[string(source)]
+			if !ok {
+				i = len(images)
+				bySource[string(source)] = i
+				img := Image{Rating: rating}
+				copy(img.MD5[:], source)
+				images = append(images, img)
+				ids = append(ids, id)
+			}
+			images[i].Crops = append(images[i].Crops, c)
+		}
+		return r.Err()
+	}()
+	if err != nil {
+		return
+	}
+
+	// All crops of an image share the same tags
+	for i := range images {
+		err = func() (err error) {
+			r, err := sq.Select("tag", "source").
+				From("image_tags").
+				Where("image_id = ?", ids[i]).
+				OrderBy("tag").
+				Query()
+			if err != nil {
+				return
+			}
+			defer r.Close()
+
+			img := &images[i]
+			for r.Next() {
+				var tag string
+				err = r.Scan(&tag, &img.Source)
+				if err != nil {
+					return
+				}
+				img.Tags = append(img.Tags, tag)
+			}
+			return r.Err()
+		}()
+		if err != nil {
+			return
+		}
+	}
+	return
 }
 
 // Add image to blacklist so that it is not fetched again
@@ -71,20 +397,159 @@ func BlacklistImage(hash [16]byte) (err error) {
 
 	_, err = sq.
 		Insert("images").
-		Columns("hash", "blacklist").
-		Values(hash[:], true).
+		Columns("hash", "source_hash", "blacklist").
+		Values(hash[:], hash[:], true).
 		Exec()
 	return
 }
 
-// Return count of images matching selectors
+// Called with the MD5 hash of every source image blacklisted by
+// BlacklistTagged or BlacklistUntagged and the with tag passed to it, if set.
+// Must be set before Open.
+var OnBlacklist func(md5 [16]byte, tag string)
+
+// Blacklist all images tagged with any of tags and none of except. If with is
+// set, only images also tagged with it are blacklisted. Returns the number of
+// blacklisted source images.
+func BlacklistTagged(tags []string, with string, except []string,
+) (n int, err error) {
+	if len(tags) == 0 {
+		return
+	}
+	tags = append([]string(nil), tags...)
+	lowercaseTags(tags)
+	tagged := func(tags ...string) squirrel.Sqlizer {
+		args := make([]interface{}, len(tags))
+		for i, t := range tags {
+			args[i] = t
+		}
+		return squirrel.Expr(
+			`exists (
+				select 1
+				from image_tags
+				where image_id = images.id and tag in (`+
+				squirrel.Placeholders(len(tags))+`))`,
+			args...,
+		)
+	}
+	cond := squirrel.And{
+		squirrel.Eq{"blacklist": false},
+		tagged(tags...),
+	}
+	if with != "" {
+		cond = append(cond, tagged(strings.ToLower(with)))
+	}
+	if len(except) != 0 {
+		except = append([]string(nil), except...)
+		lowercaseTags(except)
+		q, args, err := tagged(except...).ToSql()
+		if err != nil {
+			return 0, err
+		}
+		cond = append(cond, squirrel.Expr("not "+q, args...))
+	}
+
+	return blacklistWhere(cond, with)
+}
+
+// Blacklist all images missing any of require. If with is set, only images
+// tagged with it are blacklisted. Returns the number of blacklisted source
+// images.
+func BlacklistUntagged(require []string, with string) (n int, err error) {
+	if len(require) == 0 {
+		return
+	}
+	tagged := func(tag string) squirrel.Sqlizer {
+		return squirrel.Expr(
+			`exists (
+				select 1
+				from image_tags
+				where image_id = images.id and tag = ?)`,
+			strings.ToLower(tag),
+		)
+	}
+	missing := make(squirrel.Or, 0, len(require))
+	for _, t := range require {
+		q, args, err := tagged(t).ToSql()
+		if err != nil {
+			return 0, err
+		}
+		missing = append(missing, squirrel.Expr("not "+q, args...))
+	}
+	cond := squirrel.And{
+		squirrel.Eq{"blacklist": false},
+		missing,
+	}
+	if with != "" {
+		cond = append(cond, tagged(with))
+	}
+	return blacklistWhere(cond, with)
+}
+
+// Blacklist all images matching cond and report them to OnBlacklist with the
+// with tag
+func blacklistWhere(cond squirrel.Sqlizer, with string) (n int, err error) {
+	var blacklisted [][16]byte
+	dbMu.Lock()
+	err = InTransaction(func(tx *sql.Tx) (err error) {
+		r, err := sq.Select("distinct source_hash").
+			From("images").
+			Where(cond).
+			RunWith(tx).
+			Query()
+		if err != nil {
+			return
+		}
+		defer r.Close()
+
+		var buf []byte
+		for r.Next() {
+			err = r.Scan(&buf)
+			if err != nil {
+				return
+			}
+			var md5 [16]byte
+			copy(md5[:], buf)
+			blacklisted = append(blacklisted, md5)
+		}
+		err = r.Err()
+		if err != nil || len(blacklisted) == 0 {
+			return
+		}
+
+		_, err = sq.Update("images").
+			Set("blacklist", true).
+			Where(cond).
+			RunWith(tx).
+			Exec()
+		return
+	})
+	if err == nil && len(blacklisted) != 0 {
+		resetPHashIndex()
+	}
+	dbMu.Unlock()
+	if err != nil {
+		return
+	}
+
+	n = len(blacklisted)
+	// Call outside of the lock to allow the hook to use the database
+	if OnBlacklist != nil {
+		for _, md5 := range blacklisted {
+			OnBlacklist(md5, strings.ToLower(with))
+		}
+	}
+	return
+}
+
+// Return count of distinct source images matching selectors
 func ImageCount(f Filters) (n int, err error) {
 	f.Tag = strings.ToLower(f.Tag)
 
 	dbMu.RLock()
 	defer dbMu.RUnlock()
 
-	err = sq.Select("count(*)").
+	err = sq.Select("count(distinct source_hash)").
 		From("image_tags").
 		Join("images on image_id = images.id").
 		Where(squirrel.Eq{
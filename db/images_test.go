@@ -0,0 +1,337 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/bakape/boorufetch"
+	"github.com/bakape/captchouli/v2/common"
+)
+
+func TestImageQuality(t *testing.T) {
+	q := common.Quality{
+		FaceSize:     120,
+		RelativeSize: 0.05,
+		Sharpness:    312.5,
+		Contrast:     48.25,
+		Confidence:   3.5,
+		Aspect:       1,
+	}
+	img := Image{
+		Tags: []string{"cirno"},
+	}
+	_, err := rand.Read(img.MD5[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Crops = []Crop{{
+		Hash:    img.MD5,
+		Quality: q,
+	}}
+	err = InsertImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := GetQuality(img.MD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != q {
+		t.Fatalf("quality mismatch: %+v != %+v", res, q)
+	}
+
+	_, err = GetQuality([16]byte{})
+	if err != sql.ErrNoRows {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMultipleCrops(t *testing.T) {
+	img := Image{}
+	_, err := rand.Read(img.MD5[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := hex.EncodeToString(img.MD5[:])
+	img.Tags = []string{tag}
+	for i := 0; i < 3; i++ {
+		img.Crops = append(img.Crops, Crop{
+			Hash: common.CropHash(img.MD5, i),
+		})
+	}
+	err = InsertImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, md5 := range [...][16]byte{img.MD5, img.Crops[2].Hash} {
+		in, err := IsInDatabase(md5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in != (md5 == img.MD5) {
+			t.Fatalf("%x: unexpected IsInDatabase result: %t", md5, in)
+		}
+	}
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.General},
+	}
+	f.Tag = tag
+	n, err := ImageCount(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("crops counted as separate images: %d", n)
+	}
+
+	// Only one crop of the source may be selected
+	var (
+		images [9][16]byte
+		sel    selection
+	)
+	q := sq.Select("hash", "source_hash", "phash", "0 as rank").
+		From("images").
+		Where("source_hash = ?", img.MD5[:])
+	err = sel.pick(q, 9, 0, &images)
+	if err != common.ErrNotEnoughImages {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if images[1] != [16]byte{} {
+		t.Fatal("multiple crops of the same source selected")
+	}
+}
+
+func TestNearDuplicates(t *testing.T) {
+	img := Image{}
+	_, err := rand.Read(img.MD5[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	phash := binary.LittleEndian.Uint64(img.MD5[:])
+	img.Tags = []string{hex.EncodeToString(img.MD5[:])}
+	img.Crops = []Crop{{
+		Hash:     img.MD5,
+		PHash:    phash,
+		HasPHash: true,
+	}}
+	err = InsertImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		name      string
+		phash     uint64
+		duplicate bool
+	}{
+		{"identical", phash, true},
+		{"similar", phash ^ 0x7, true},
+		{"different", ^phash, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hash, found, err := FindDuplicate(c.phash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != c.duplicate {
+				t.Fatalf("unexpected result: %t", found)
+			}
+			if found && hash != img.MD5 {
+				t.Fatalf("unexpected duplicate: %x", hash)
+			}
+		})
+	}
+
+	// Blacklisted images are not duplicates
+	_, err = BlacklistTagged(img.Tags, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, found, err := FindDuplicate(phash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("blacklisted image considered duplicate")
+	}
+
+	var sel selection
+	sel = append(sel, sql.NullInt64{Int64: int64(phash), Valid: true})
+	if !sel.similar(sql.NullInt64{Int64: int64(phash ^ 0x1), Valid: true}) {
+		t.Fatal("similar image not detected")
+	}
+	if sel.similar(sql.NullInt64{}) {
+		t.Fatal("image without hash considered similar")
+	}
+}
+
+func TestZeroPerceptualHash(t *testing.T) {
+	img := Image{Tags: []string{randomTag(t)}}
+	_, err := rand.Read(img.MD5[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Crops = []Crop{{
+		Hash:     img.MD5,
+		HasPHash: true,
+	}}
+	err = InsertImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := GetImages(img.Tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || !images[0].Crops[0].HasPHash {
+		t.Fatalf("perceptual hash not stored: %+v", images)
+	}
+	unhashed, err := GetUnhashedImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range unhashed {
+		if h == img.MD5 {
+			t.Fatal("zero perceptual hash considered not computed")
+		}
+	}
+
+	SetDuplicateDistance(0)
+	defer SetDuplicateDistance(10)
+	// Don't match this image in later runs on the persistent test database
+	defer BlacklistTagged(img.Tags, "", nil)
+	_, found, err := FindDuplicate(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("identical image not detected")
+	}
+	_, found, err = FindDuplicate(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("different image detected with zero distance")
+	}
+}
+
+func TestBandNeighbours(t *testing.T) {
+	for r := 0; r <= 3; r++ {
+		seen := make(map[uint16]bool)
+		forBandNeighbours(0xf0f0, r, 0, func(v uint16) bool {
+			if seen[v] {
+				t.Fatalf("value visited twice: %x", v)
+			}
+			if d := bits.OnesCount16(v ^ 0xf0f0); d > r {
+				t.Fatalf("value too distant: %x", v)
+			}
+			seen[v] = true
+			return false
+		})
+		if len(seen) != bandNeighbourCount(r) {
+			t.Fatalf("unexpected neighbour count for %d: %d", r, len(seen))
+		}
+	}
+}
+
+func TestBlacklistTagged(t *testing.T) {
+	tag, banned, exempt := randomTag(t), randomTag(t), randomTag(t)
+	insertTagged(t, 2, tag, banned)
+	insertTagged(t, 1, tag, banned, exempt)
+	insertTagged(t, 1, banned)
+	insertTagged(t, 2, tag)
+
+	var reported []string
+	OnBlacklist = func(_ [16]byte, tag string) {
+		reported = append(reported, tag)
+	}
+	defer func() {
+		OnBlacklist = nil
+	}()
+
+	n, err := BlacklistTagged([]string{banned}, tag, []string{exempt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected blacklisted image count: %d", n)
+	}
+	if len(reported) != 2 || reported[0] != tag || reported[1] != tag {
+		t.Fatalf("unexpected reported images: %v", reported)
+	}
+	assertImageCount(t, tag, 3)
+	assertImageCount(t, banned, 2)
+
+	n, err = BlacklistTagged([]string{strings.ToUpper(banned)}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected blacklisted image count: %d", n)
+	}
+	assertImageCount(t, banned, 0)
+}
+
+func TestBlacklistUntagged(t *testing.T) {
+	tag, a, b := randomTag(t), randomTag(t), randomTag(t)
+	insertTagged(t, 2, tag, a, b)
+	insertTagged(t, 1, tag, a)
+	insertTagged(t, 1, tag)
+	insertTagged(t, 1, a)
+
+	n, err := BlacklistUntagged([]string{a, strings.ToUpper(b)}, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected blacklisted image count: %d", n)
+	}
+	assertImageCount(t, tag, 2)
+	assertImageCount(t, a, 3)
+}
+
+func TestGetImages(t *testing.T) {
+	tag := randomTag(t)
+	bad := tag + "_bad"
+	std := insertTagged(t, 1, tag)[0]
+	insertTagged(t, 1, tag, bad)
+	insertTagged(t, 1, randomTag(t))
+	_, err := BlacklistTagged([]string{bad}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := GetImages([]string{strings.ToUpper(tag)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("unexpected image count: %d", len(images))
+	}
+	img := images[0]
+	if img.MD5 != std || img.Rating != boorufetch.Questionable ||
+		img.Source != common.Danbooru {
+		t.Fatalf("unexpected image: %+v", img)
+	}
+	if len(img.Crops) != 1 || img.Crops[0].Hash != std {
+		t.Fatalf("unexpected crops: %+v", img.Crops)
+	}
+	tags := []string{hex.EncodeToString(std[:]), tag}
+	if tags[0] > tags[1] {
+		tags[0], tags[1] = tags[1], tags[0]
+	}
+	if len(img.Tags) != 2 || img.Tags[0] != tags[0] || img.Tags[1] != tags[1] {
+		t.Fatalf("unexpected tags: %v", img.Tags)
+	}
+}
@@ -10,10 +10,14 @@ import (
 
 	"github.com/Masterminds/squirrel"
 	"github.com/bakape/captchouli/v2/common"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
+	// Name of the database/sql driver used to open the SQLite database.
+	// Defaults to github.com/mattn/go-sqlite3 in builds with cgo and to the
+	// pure-Go modernc.org/sqlite otherwise.
+	Driver = defaultDriver
+
 	db *sql.DB
 	sq squirrel.StatementBuilderType
 
@@ -39,7 +43,7 @@ func Open() (err error) {
 		}
 	}
 
-	db, err = sql.Open("sqlite3",
+	db, err = sql.Open(Driver,
 		fmt.Sprintf("file:%s?cache=shared&mode=rwc",
 			filepath.Join(common.RootDir, "db.db")))
 	if err != nil {
@@ -54,7 +58,8 @@ func Open() (err error) {
 		QueryRow().
 		Scan(&currentVersion)
 	if err != nil {
-		if s := err.Error(); strings.HasPrefix(s, "no such table") {
+		// Drivers differ in error message prefixes
+		if s := err.Error(); strings.Contains(s, "no such table") {
 			err = nil
 		} else {
 			return
@@ -76,9 +81,18 @@ func Close() error {
 	dbMu.Lock()
 	defer dbMu.Unlock()
 
+	resetPHashIndex()
 	return db.Close()
 }
 
+// Check, if the database is reachable
+func Ping() error {
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	return db.Ping()
+}
+
 // Open database for testing purposes
 func OpenForTests() {
 	common.IsTest = true
@@ -4,7 +4,8 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
-	"log"
+
+	"github.com/bakape/captchouli/v2/common"
 )
 
 var version = len(migrations)
@@ -68,6 +69,64 @@ var migrations = []func(*sql.Tx) error{
 			createIndex("pending_images", "target_tag", false),
 		)
 	},
+	func(tx *sql.Tx) (err error) {
+		return execAll(tx,
+			`alter table captchas add column tag text not null default ''`,
+		)
+	},
+	func(tx *sql.Tx) (err error) {
+		return execAll(tx,
+			`alter table images add column face_size integer`,
+			`alter table images add column relative_size real`,
+			`alter table images add column sharpness real`,
+			`alter table images add column contrast real`,
+			`alter table images add column confidence real`,
+			`alter table images add column aspect real`,
+		)
+	},
+	func(tx *sql.Tx) (err error) {
+		return execAll(tx,
+			`alter table images add column source_hash blob`,
+			`update images set source_hash = hash`,
+			createIndex("images", "source_hash", false),
+		)
+	},
+	func(tx *sql.Tx) (err error) {
+		return execAll(tx,
+			`alter table images add column phash integer`,
+		)
+	},
+	func(tx *sql.Tx) (err error) {
+		return execAll(tx,
+			`create table tag_aliases (
+				antecedent text primary key,
+				consequent text not null
+			)`,
+			`create table tag_implications (
+				antecedent text not null,
+				consequent text not null,
+				primary key (antecedent, consequent)
+			)`,
+			createIndex("tag_implications", "consequent", false),
+		)
+	},
+	func(tx *sql.Tx) (err error) {
+		return execAll(tx,
+			`create table page_counts (
+				query text primary key,
+				tag text not null,
+				max_pages integer not null,
+				updated datetime not null
+			)`,
+			createIndex("page_counts", "tag", false),
+			`create table fetched_pages (
+				query text not null references page_counts on delete cascade,
+				page integer not null,
+				fetched datetime not null,
+				primary key (query, page)
+			)`,
+		)
+	},
 }
 
 // Run migrations from version `from`to version `to`
@@ -82,7 +141,7 @@ func runMigrations(from, to int) (err error) {
 	}
 
 	for i := from; i < to; i++ {
-		log.Printf("captchouli: upgrading database to version %d\n", i+1)
+		common.LogInfo("upgrading database", "version", i+1)
 		tx, err = db.Begin()
 		if err != nil {
 			return
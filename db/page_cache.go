@@ -0,0 +1,134 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Pages of a booru tag query already fetched
+type PageCache struct {
+	// Estimate for the maximum number of pages. Zero, if the query matches no
+	// posts.
+	MaxPages int
+
+	// Fetched pages below MaxPages
+	Pages map[int]struct{}
+}
+
+// Return the page cache of a booru tag query, ignoring any entries older than
+// ttl. found is false, if no page count is recorded for the query or it
+// has expired.
+func GetPageCache(query string, ttl time.Duration,
+) (c PageCache, found bool, err error) {
+	threshold := time.Now().Add(-ttl).UTC()
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	err = sq.Select("max_pages").
+		From("page_counts").
+		Where("query = ? and updated >= ?", query, threshold).
+		QueryRow().
+		Scan(&c.MaxPages)
+	switch err {
+	case nil:
+		found = true
+	case sql.ErrNoRows:
+		err = nil
+		return
+	default:
+		return
+	}
+
+	r, err := sq.Select("page").
+		From("fetched_pages").
+		Where("query = ? and page < ? and fetched >= ?", query, c.MaxPages,
+			threshold).
+		Query()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	c.Pages = make(map[int]struct{})
+	for r.Next() {
+		var page int
+		err = r.Scan(&page)
+		if err != nil {
+			return
+		}
+		c.Pages[page] = struct{}{}
+	}
+	err = r.Err()
+	return
+}
+
+// Record the estimated maximum number of pages of a booru tag query fetched
+// for tag. Recording a new estimate for an expired or missing entry clears
+// the fetched pages of the query.
+func SetMaxPages(query, tag string, maxPages int, fresh bool) (err error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	return InTransaction(func(tx *sql.Tx) (err error) {
+		if fresh {
+			_, err = sq.Delete("fetched_pages").
+				Where("query = ?", query).
+				RunWith(tx).
+				Exec()
+			if err != nil {
+				return
+			}
+		}
+		_, err = sq.Insert("page_counts").
+			Columns("query", "tag", "max_pages", "updated").
+			Values(query, strings.ToLower(tag), maxPages, time.Now().UTC()).
+			Suffix(`on conflict (query) do update
+				set tag = excluded.tag,
+					max_pages = excluded.max_pages,
+					updated = excluded.updated`).
+			RunWith(tx).
+			Exec()
+		return
+	})
+}
+
+// Record a page of a booru tag query as fetched
+func SetPageFetched(query string, page int) (err error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	_, err = sq.Insert("fetched_pages").
+		Columns("query", "page", "fetched").
+		Values(query, page, time.Now().UTC()).
+		Suffix(`on conflict (query, page)
+			do update set fetched = excluded.fetched`).
+		Exec()
+	return
+}
+
+// Clear the page caches of all booru tag queries fetched for tag, so pages are
+// fetched again starting with the first one
+func ResetPageCache(tag string) (err error) {
+	tag = strings.ToLower(tag)
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	return InTransaction(func(tx *sql.Tx) (err error) {
+		_, err = sq.Delete("fetched_pages").
+			Where(`query in (select query from page_counts where tag = ?)`,
+				tag).
+			RunWith(tx).
+			Exec()
+		if err != nil {
+			return
+		}
+		_, err = sq.Delete("page_counts").
+			Where("tag = ?", tag).
+			RunWith(tx).
+			Exec()
+		return
+	})
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPageCache(t *testing.T) {
+	tag := randomTag(t)
+	query := tag + " solo"
+
+	assertCache := func(ttl time.Duration, found bool, maxPages int,
+		pages ...int,
+	) {
+		t.Helper()
+
+		c, ok, err := GetPageCache(query, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != found {
+			t.Fatalf("unexpected found state: %t", ok)
+		}
+		if c.MaxPages != maxPages || len(c.Pages) != len(pages) {
+			t.Fatalf("unexpected cache: %+v", c)
+		}
+		for _, p := range pages {
+			if _, ok := c.Pages[p]; !ok {
+				t.Fatalf("page not cached: %d", p)
+			}
+		}
+	}
+
+	assertCache(time.Hour, false, 0)
+
+	err := SetMaxPages(query, tag, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [...]int{0, 3, 7} {
+		err = SetPageFetched(query, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertCache(time.Hour, true, 10, 0, 3, 7)
+
+	// Pages past the new estimate are ignored
+	err = SetMaxPages(query, tag, 5, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCache(time.Hour, true, 5, 0, 3)
+
+	// Expired
+	time.Sleep(10 * time.Millisecond)
+	assertCache(time.Millisecond, false, 0)
+
+	err = ResetPageCache(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCache(time.Hour, false, 0)
+}
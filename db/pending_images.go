@@ -67,7 +67,7 @@ func PopRandomPendingImage(tag string) (img PendingImage, err error) {
 			From("pending_images").
 			Where("target_tag = ?", tag).
 			OrderBy("hash").
-			Offset(uint64(common.RandomInt(n))).
+			Offset(uint64(common.FetchRand.Int(n))).
 			Limit(1).
 			RunWith(tx).
 			QueryRow().
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+// Number of 16 bit bands perceptual hashes are split into for indexing
+const phashBands = 4
+
+// In-memory index of the perceptual hashes of non-blacklisted pool images.
+// Loaded from the database on first use. Only modified with dbMu held to stay
+// consistent with the database.
+//
+// Uses multi-index hashing: hashes within a Hamming distance d of each other
+// have at least one band within a distance of d / phashBands of each other,
+// so only images with a matching band value need to be compared.
+var phashes struct {
+	sync.RWMutex
+	loaded bool
+	crops  map[[16]byte]uint64 // Perceptual hash by crop hash
+	bands  [phashBands]map[uint16][][16]byte
+}
+
+// Return the band-th 16 bit band of a perceptual hash
+func phashBand(phash uint64, band int) uint16 {
+	return uint16(phash >> uint(16*band))
+}
+
+// Load all perceptual hashes from the database into the index, if not loaded
+// yet. Must be called with dbMu held.
+func loadPHashIndex() (err error) {
+	phashes.Lock()
+	defer phashes.Unlock()
+
+	if phashes.loaded {
+		return
+	}
+
+	r, err := sq.Select("hash", "phash").
+		From("images").
+		Where("phash is not null and blacklist = false").
+		Query()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	phashes.crops = make(map[[16]byte]uint64)
+	for i := range phashes.bands {
+		phashes.bands[i] = make(map[uint16][][16]byte)
+	}
+	var (
+		buf []byte
+		p   int64
+	)
+	for r.Next() {
+		err = r.Scan(&buf, &p)
+		if err != nil {
+			return
+		}
+		var hash [16]byte
+		copy(hash[:], buf)
+		indexPHash(hash, uint64(p))
+	}
+	err = r.Err()
+	if err != nil {
+		return
+	}
+	phashes.loaded = true
+	return
+}
+
+// Add a crop to the index. Must be called with phashes locked.
+func indexPHash(hash [16]byte, phash uint64) {
+	if old, ok := phashes.crops[hash]; ok {
+		for i := range phashes.bands {
+			b := phashBand(old, i)
+			hashes := phashes.bands[i][b]
+			for j, h := range hashes {
+				if h == hash {
+					hashes[j] = hashes[len(hashes)-1]
+					hashes = hashes[:len(hashes)-1]
+					break
+				}
+			}
+			if len(hashes) == 0 {
+				delete(phashes.bands[i], b)
+			} else {
+				phashes.bands[i][b] = hashes
+			}
+		}
+	}
+	phashes.crops[hash] = phash
+	for i := range phashes.bands {
+		b := phashBand(phash, i)
+		phashes.bands[i][b] = append(phashes.bands[i][b], hash)
+	}
+}
+
+// Set the perceptual hash of a crop in the index, if it is loaded. Must be
+// called with dbMu locked for writing.
+func setIndexedPHash(hash [16]byte, phash uint64) {
+	phashes.Lock()
+	defer phashes.Unlock()
+
+	if phashes.loaded {
+		indexPHash(hash, phash)
+	}
+}
+
+// Drop the index to have it reloaded on next use. Must be called with dbMu
+// locked for writing.
+func resetPHashIndex() {
+	phashes.Lock()
+	defer phashes.Unlock()
+
+	phashes.loaded = false
+	phashes.crops = nil
+	for i := range phashes.bands {
+		phashes.bands[i] = nil
+	}
+}
+
+// Return the hash of an indexed crop within the configured duplicate distance
+// of phash, if any. loaded is false, if the index must be loaded first.
+func findIndexedDuplicate(phash uint64) (hash [16]byte, found, loaded bool) {
+	phashes.RLock()
+	defer phashes.RUnlock()
+
+	if !phashes.loaded {
+		return
+	}
+	loaded = true
+	max := int(atomic.LoadInt32(&duplicateDistance))
+	if max < 0 {
+		return
+	}
+
+	match := func(h [16]byte) bool {
+		if bits.OnesCount64(phashes.crops[h]^phash) <= max {
+			hash = h
+			found = true
+		}
+		return found
+	}
+
+	// Enumerating band values is only worth it for small distances
+	radius := max / phashBands
+	if radius >= 16 || phashBands*bandNeighbourCount(radius) >
+		len(phashes.crops) {
+		for h := range phashes.crops {
+			if match(h) {
+				return
+			}
+		}
+		return
+	}
+	for i := range phashes.bands {
+		band := phashes.bands[i]
+		found = forBandNeighbours(phashBand(phash, i), radius, 0,
+			func(b uint16) bool {
+				for _, h := range band[b] {
+					if match(h) {
+						return true
+					}
+				}
+				return false
+			})
+		if found {
+			return
+		}
+	}
+	return
+}
+
+// Return the number of 16 bit values within a Hamming distance of r of any
+// 16 bit value
+func bandNeighbourCount(r int) (n int) {
+	c := 1 // Binomial coefficient 16 choose i
+	for i := 0; i <= r; i++ {
+		n += c
+		c = c * (16 - i) / (i + 1)
+	}
+	return
+}
+
+// Call fn with v and all values within a Hamming distance of r of v, that
+// only differ from v in bits from the from-th bit up. Stops and returns true,
+// as soon as fn returns true.
+func forBandNeighbours(v uint16, r, from int, fn func(uint16) bool) bool {
+	if fn(v) {
+		return true
+	}
+	if r == 0 {
+		return false
+	}
+	for i := from; i < 16; i++ {
+		if forBandNeighbours(v^1<<uint(i), r-1, i+1, fn) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+)
+
+// Record the current name of a booru tag. A tag without an alias is recorded
+// as its own consequent. Images and pending images stored under the old name
+// are moved to the new one.
+func SetTagAlias(antecedent, consequent string) (err error) {
+	antecedent = strings.ToLower(antecedent)
+	consequent = strings.ToLower(consequent)
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	return InTransaction(func(tx *sql.Tx) (err error) {
+		_, err = sq.Insert("tag_aliases").
+			Columns("antecedent", "consequent").
+			Values(antecedent, consequent).
+			Suffix(`on conflict (antecedent)
+				do update set consequent = excluded.consequent`).
+			RunWith(tx).
+			Exec()
+		if err != nil || antecedent == consequent {
+			return
+		}
+
+		// Chained renames resolve to the newest name
+		_, err = sq.Update("tag_aliases").
+			Set("consequent", consequent).
+			Where("consequent = ?", antecedent).
+			RunWith(tx).
+			Exec()
+		if err != nil {
+			return
+		}
+
+		_, err = tx.Exec(
+			`insert or ignore into image_tags (image_id, tag, source)
+			select image_id, ?, source
+			from image_tags
+			where tag = ?`,
+			consequent, antecedent)
+		if err != nil {
+			return
+		}
+		_, err = sq.Delete("image_tags").
+			Where("tag = ?", antecedent).
+			RunWith(tx).
+			Exec()
+		if err != nil {
+			return
+		}
+		_, err = sq.Update("pending_images").
+			Set("target_tag", consequent).
+			Where("target_tag = ?", antecedent).
+			RunWith(tx).
+			Exec()
+		return
+	})
+}
+
+// Return the current name of a booru tag and, if it has been recorded at all
+func ResolveTagAlias(tag string) (consequent string, found bool, err error) {
+	tag = strings.ToLower(tag)
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	err = sq.Select("consequent").
+		From("tag_aliases").
+		Where("antecedent = ?", tag).
+		QueryRow().
+		Scan(&consequent)
+	switch err {
+	case nil:
+		found = true
+	case sql.ErrNoRows:
+		err = nil
+		consequent = tag
+	}
+	return
+}
+
+// Record the tags implying tag. Images stored with any of the implying tags
+// are also tagged with tag.
+func SetTagImplications(tag string, antecedents []string) (err error) {
+	tag = strings.ToLower(tag)
+	lowercaseTags(antecedents)
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	return InTransaction(func(tx *sql.Tx) (err error) {
+		_, err = sq.Delete("tag_implications").
+			Where("consequent = ?", tag).
+			RunWith(tx).
+			Exec()
+		if err != nil || len(antecedents) == 0 {
+			return
+		}
+
+		q := sq.Insert("tag_implications").
+			Columns("antecedent", "consequent")
+		for _, a := range antecedents {
+			q = q.Values(a, tag)
+		}
+		_, err = q.RunWith(tx).Exec()
+		if err != nil {
+			return
+		}
+
+		inner, args, err := sq.Select("image_id", "?", "source").
+			From("image_tags").
+			Where(squirrel.Eq{"tag": antecedents}).
+			ToSql()
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec(
+			`insert or ignore into image_tags (image_id, tag, source) `+inner,
+			append([]interface{}{tag}, args...)...)
+		return
+	})
+}
+
+// Return tags, their aliases and all tags they imply or are implied by,
+// transitively. Siblings sharing an implied tag are not included.
+func relatedTags(tags []string) (related []string, err error) {
+	seen := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		if _, ok := seen[t]; !ok {
+			seen[t] = struct{}{}
+			related = append(related, t)
+		}
+	}
+
+	dbMu.RLock()
+	defer dbMu.RUnlock()
+
+	// Return the from column of all rows of table with the to column set to t
+	query := func(table, from, to, t string) (res []string, err error) {
+		r, err := sq.Select(from).
+			From(table).
+			Where(squirrel.Eq{to: t}).
+			Query()
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		for r.Next() {
+			var s string
+			err = r.Scan(&s)
+			if err != nil {
+				return
+			}
+			res = append(res, s)
+		}
+		err = r.Err()
+		return
+	}
+
+	// Follow implications from tags in one direction only, so a common
+	// implied tag does not pull in all its other antecedents
+	follow := func(from, to string) (err error) {
+		queue := append([]string(nil), tags...)
+		visited := make(map[string]struct{}, len(tags))
+		for _, t := range tags {
+			visited[t] = struct{}{}
+		}
+		for i := 0; i < len(queue); i++ {
+			for _, q := range [...]struct {
+				table, from, to string
+			}{
+				{"tag_aliases", "antecedent", "consequent"},
+				{"tag_aliases", "consequent", "antecedent"},
+				{"tag_implications", from, to},
+			} {
+				var res []string
+				res, err = query(q.table, q.from, q.to, queue[i])
+				if err != nil {
+					return
+				}
+				for _, t := range res {
+					if _, ok := visited[t]; ok {
+						continue
+					}
+					visited[t] = struct{}{}
+					queue = append(queue, t)
+					if _, ok := seen[t]; !ok {
+						seen[t] = struct{}{}
+						related = append(related, t)
+					}
+				}
+			}
+		}
+		return
+	}
+	err = follow("consequent", "antecedent")
+	if err != nil {
+		return
+	}
+	err = follow("antecedent", "consequent")
+	return
+}
+
+// Replace aliased tags with their current names and append all implied tags
+func resolveTags(tx *sql.Tx, tags []string) (resolved []string, err error) {
+	seen := make(map[string]struct{}, len(tags))
+	add := func(t string) {
+		if _, ok := seen[t]; !ok {
+			seen[t] = struct{}{}
+			resolved = append(resolved, t)
+		}
+	}
+
+	alias, err := tx.Prepare(
+		`select consequent from tag_aliases where antecedent = ?`)
+	if err != nil {
+		return
+	}
+	defer alias.Close()
+	for _, t := range tags {
+		err = alias.QueryRow(t).Scan(&t)
+		switch err {
+		case nil, sql.ErrNoRows:
+			err = nil
+			add(t)
+		default:
+			return
+		}
+	}
+
+	implied, err := tx.Prepare(
+		`select consequent from tag_implications where antecedent = ?`)
+	if err != nil {
+		return
+	}
+	defer implied.Close()
+
+	// Implications can be chained. resolved grows during iteration.
+	for i := 0; i < len(resolved); i++ {
+		err = func() (err error) {
+			r, err := implied.Query(resolved[i])
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			for r.Next() {
+				var t string
+				err = r.Scan(&t)
+				if err != nil {
+					return
+				}
+				add(t)
+			}
+			return r.Err()
+		}()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
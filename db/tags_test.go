@@ -0,0 +1,92 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/bakape/boorufetch"
+)
+
+// Return a random tag unique to the test run
+func randomTag(t *testing.T) string {
+	t.Helper()
+
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+func assertImageCount(t *testing.T, tag string, std int) {
+	t.Helper()
+
+	f := Filters{
+		Explicitness: []boorufetch.Rating{boorufetch.Questionable},
+	}
+	f.Tag = tag
+	n, err := ImageCount(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != std {
+		t.Fatalf("%s: image count mismatch: %d != %d", tag, n, std)
+	}
+}
+
+func TestTagAliases(t *testing.T) {
+	old, renamed, latest := randomTag(t), randomTag(t), randomTag(t)
+
+	insertTagged(t, 2, old)
+	err := SetTagAlias(old, renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertImageCount(t, old, 0)
+	assertImageCount(t, renamed, 2)
+
+	// Images fetched under the old name are stored under the new one
+	insertTagged(t, 1, old)
+	assertImageCount(t, renamed, 3)
+
+	err = SetTagAlias(renamed, latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertImageCount(t, latest, 3)
+	for _, tag := range [...]string{old, renamed} {
+		res, found, err := ResolveTagAlias(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || res != latest {
+			t.Fatalf("%s: unexpected resolution: %s %t", tag, res, found)
+		}
+	}
+
+	tag := randomTag(t)
+	res, found, err := ResolveTagAlias(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found || res != tag {
+		t.Fatalf("unrecorded tag resolved: %s %t", res, found)
+	}
+}
+
+func TestTagImplications(t *testing.T) {
+	parent, child := randomTag(t), randomTag(t)
+
+	insertTagged(t, 2, child)
+	err := SetTagImplications(parent, []string{child})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertImageCount(t, parent, 2)
+
+	insertTagged(t, 1, child)
+	assertImageCount(t, parent, 3)
+	assertImageCount(t, child, 3)
+}
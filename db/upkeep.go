@@ -1,7 +1,7 @@
 package db
 
 import (
-	"log"
+	"database/sql"
 	"time"
 
 	"github.com/bakape/captchouli/v2/common"
@@ -10,33 +10,90 @@ import (
 // Time it takes for one captcha to expire
 const expiryTime = 30 * time.Minute
 
+// Called with the ID and tag of every captcha deleted due to expiry, if set.
+// Must be set before Open.
+var OnExpire func(id [64]byte, tag string)
+
 func runUpkeepTasks() {
 	go func() {
 		min := time.Tick(time.Minute)
 		hour := time.Tick(time.Hour)
 		for {
-			var err error
+			var (
+				err  error
+				task string
+			)
 			select {
 			case <-min:
+				task = "delete stale captchas"
 				err = deleteStaleCaptchas()
 			case <-hour:
+				task = "vacuum"
 				err = vacuum()
 			}
 			if err != nil {
-				log.Println(common.Error{err})
+				common.LogError("upkeep task failed", "task", task,
+					"error", err)
 			}
 		}
 	}()
 }
 
 func deleteStaleCaptchas() error {
+	type expired struct {
+		id  [64]byte
+		tag string
+	}
+	var deleted []expired
+
 	dbMu.Lock()
-	defer dbMu.Unlock()
+	err := InTransaction(func(tx *sql.Tx) (err error) {
+		threshold := time.Now().Add(-expiryTime).UTC()
+		if OnExpire != nil {
+			r, err := sq.Select("id", "tag").
+				From("captchas").
+				Where("created < ?", threshold).
+				RunWith(tx).
+				Query()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
 
-	_, err := sq.Delete("captchas").
-		Where("created < ? ", time.Now().Add(-expiryTime).UTC()).
-		Exec()
-	return err
+			var (
+				e  expired
+				id []byte
+			)
+			for r.Next() {
+				err = r.Scan(&id, &e.tag)
+				if err != nil {
+					return err
+				}
+				copy(e.id[:], id)
+				deleted = append(deleted, e)
+			}
+			err = r.Err()
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = sq.Delete("captchas").
+			Where("created < ? ", threshold).
+			RunWith(tx).
+			Exec()
+		return
+	})
+	dbMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Call outside of the lock to allow the hook to use the database
+	for _, e := range deleted {
+		OnExpire(e.id, e.tag)
+	}
+	return nil
 }
 
 func vacuum() error {
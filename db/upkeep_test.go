@@ -1,6 +1,9 @@
 package db
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestUpkeep(t *testing.T) {
 	err := deleteStaleCaptchas()
@@ -12,3 +15,39 @@ func TestUpkeep(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestExpiryHook(t *testing.T) {
+	var id [64]byte
+	id[0] = 1
+	_, err := sq.Insert("captchas").
+		Columns("id", "solution", "tag", "created").
+		Values(id[:], []byte{1, 2}, "cirno",
+			time.Now().Add(-expiryTime-time.Minute).UTC()).
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		expiredID  [64]byte
+		expiredTag string
+	)
+	OnExpire = func(id [64]byte, tag string) {
+		expiredID = id
+		expiredTag = tag
+	}
+	defer func() {
+		OnExpire = nil
+	}()
+
+	err = deleteStaleCaptchas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expiredID != id {
+		t.Fatal(expiredID)
+	}
+	if expiredTag != "cirno" {
+		t.Fatal(expiredTag)
+	}
+}
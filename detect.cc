@@ -0,0 +1,149 @@
+//go:build cgo && !nocv
+// +build cgo,!nocv
+
+extern "C" {
+#include "detect.h"
+}
+#include "util.hh"
+#include <algorithm>
+#include <cstdlib>
+#include <cstring>
+#include <opencv2/dnn.hpp>
+#include <opencv2/opencv.hpp>
+#include <vector>
+
+// Copy faces to a malloced FaceList
+static void write_faces(const std::vector<Face>& faces, FaceList* out)
+{
+    out->len = faces.size();
+    if (!faces.size()) {
+        return;
+    }
+    const auto s = sizeof(Face) * faces.size();
+    out->faces = static_cast<Face*>(memcpy(malloc(s), faces.data(), s));
+}
+
+static const char* detect_cascade(cv::CascadeClassifier* c, const char* path,
+    const CascadeOptions& opts, FaceList* out)
+{
+    const cv::Mat colour = cv::imread(path, cv::IMREAD_COLOR);
+    if (colour.empty()) {
+        return 0;
+    }
+
+    cv::Mat gray, equalized;
+    cv::cvtColor(colour, gray, cv::COLOR_BGR2GRAY);
+    cv::equalizeHist(gray, equalized);
+
+    std::vector<cv::Rect> rects;
+    std::vector<int> reject_levels;
+    std::vector<double> level_weights;
+    c->detectMultiScale(equalized, rects, reject_levels, level_weights,
+        opts.scale_factor, opts.min_neighbors, 0,
+        cv::Size(opts.min_size, opts.min_size), cv::Size(), true);
+
+    std::vector<Face> faces;
+    faces.reserve(rects.size());
+    for (size_t i = 0; i < rects.size(); i++) {
+        const auto& r = rects[i];
+        faces.push_back({ r.x, r.y, r.width, r.height,
+            i < level_weights.size() ? level_weights[i] : 0 });
+    }
+    write_faces(faces, out);
+    return 0;
+}
+
+static const char* detect_dnn(cv::dnn::Net* net, const char* path,
+    const DNNOptions& opts, FaceList* out)
+{
+    const cv::Mat img = cv::imread(path, cv::IMREAD_COLOR);
+    if (img.empty()) {
+        return 0;
+    }
+
+    net->setInput(cv::dnn::blobFromImage(img, opts.scale,
+        cv::Size(opts.input_size, opts.input_size),
+        cv::Scalar(opts.mean[0], opts.mean[1], opts.mean[2]), opts.swap_rb,
+        false));
+    cv::Mat res = net->forward();
+
+    // SSD detection output of shape [1, 1, N, 7] with rows of
+    // [image_id, label, confidence, left, top, right, bottom] and coordinates
+    // normalized to [0;1]
+    const cv::Mat dets(res.size[2], res.size[3], CV_32F, res.ptr<float>());
+    std::vector<Face> faces;
+    for (int i = 0; i < dets.rows; i++) {
+        const float conf = dets.at<float>(i, 2);
+        if (conf < opts.confidence_threshold) {
+            continue;
+        }
+
+        auto clamp = [](float v, int max) {
+            return std::max(0, std::min(int(v * max), max));
+        };
+        const int x1 = clamp(dets.at<float>(i, 3), img.cols);
+        const int y1 = clamp(dets.at<float>(i, 4), img.rows);
+        const int x2 = clamp(dets.at<float>(i, 5), img.cols);
+        const int y2 = clamp(dets.at<float>(i, 6), img.rows);
+        if (x2 <= x1 || y2 <= y1) {
+            continue;
+        }
+        faces.push_back({ x1, y1, x2 - x1, y2 - y1, conf });
+    }
+    write_faces(faces, out);
+    return 0;
+}
+
+extern "C" void* cpli_load_classifier(const char* path)
+{
+    auto c = new cv::CascadeClassifier();
+    if (!c->load(path)) {
+        delete c;
+        return nullptr;
+    }
+    return c;
+}
+
+extern "C" void cpli_unload_classifier(void* c)
+{
+    delete static_cast<cv::CascadeClassifier*>(c);
+}
+
+extern "C" char* cpli_detect_cascade(void* classifier, const char* path,
+    const CascadeOptions* opts, FaceList* out)
+{
+    return cpli_catch_errors([=]() {
+        return detect_cascade(
+            static_cast<cv::CascadeClassifier*>(classifier), path, *opts, out);
+    });
+}
+
+extern "C" void* cpli_load_dnn(const char* model, const char* config)
+{
+    try {
+        auto net = new cv::dnn::Net(
+            cv::dnn::readNet(model, config ? config : ""));
+        if (net->empty()) {
+            delete net;
+            return nullptr;
+        }
+        net->setPreferableBackend(cv::dnn::DNN_BACKEND_OPENCV);
+        net->setPreferableTarget(cv::dnn::DNN_TARGET_CPU);
+        return net;
+    } catch (...) {
+        return nullptr;
+    }
+}
+
+extern "C" void cpli_unload_dnn(void* net)
+{
+    delete static_cast<cv::dnn::Net*>(net);
+}
+
+extern "C" char* cpli_detect_dnn(
+    void* net, const char* path, const DNNOptions* opts, FaceList* out)
+{
+    return cpli_catch_errors([=]() {
+        return detect_dnn(static_cast<cv::dnn::Net*>(net), path, *opts, out);
+    });
+}
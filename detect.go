@@ -0,0 +1,225 @@
+//go:build cgo && !nocv
+// +build cgo,!nocv
+
+package captchouli
+
+// #include "detect.h"
+// #include <stdlib.h>
+import "C"
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// Face detector backed by a pool of native detector instances. A native
+// instance can only be used by one thread at a time.
+type pooledDetector struct {
+	// Loading and unloading is protected by mu
+	mu     sync.RWMutex
+	pool   chan unsafe.Pointer
+	loaded int
+	unload func(unsafe.Pointer)
+	detect func(d unsafe.Pointer, path *C.char, out *C.FaceList) *C.char
+}
+
+// Load a pool of n detector instances with load
+func newPooledDetector(n int, load func() unsafe.Pointer,
+	unload func(unsafe.Pointer),
+) (d *pooledDetector, err error) {
+	d = &pooledDetector{
+		pool:   make(chan unsafe.Pointer, n),
+		unload: unload,
+	}
+	for i := 0; i < n; i++ {
+		c := load()
+		if c == nil {
+			d.Close()
+			return nil, Error{errors.New("unable to load face detector")}
+		}
+		d.pool <- c
+		d.loaded++
+	}
+	return
+}
+
+// Return maximum number of concurrent detections
+func (d *pooledDetector) Concurrency() int {
+	return cap(d.pool)
+}
+
+func (d *pooledDetector) Detect(path string) (faces []Face, err error) {
+	// Hold the read lock to prevent unloading, while an instance is in use
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.pool == nil {
+		err = Error{errors.New("face detector closed")}
+		return
+	}
+	c := <-d.pool
+	defer func() {
+		d.pool <- c
+	}()
+
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+
+	var out C.FaceList
+	errC := d.detect(c, pathC, &out)
+	if out.faces != nil {
+		defer C.free(unsafe.Pointer(out.faces))
+	}
+	if errC != nil {
+		defer C.free(unsafe.Pointer(errC))
+		err = Error{errors.New(C.GoString(errC))}
+		return
+	}
+
+	if out.len != 0 {
+		src := (*[1 << 28]C.Face)(unsafe.Pointer(out.faces))[:out.len:out.len]
+		faces = make([]Face, len(src))
+		for i, f := range src {
+			x, y := int(f.x), int(f.y)
+			faces[i] = Face{
+				Rectangle: image.Rect(x, y,
+					x+int(f.width), y+int(f.height)),
+				Confidence: float64(f.confidence),
+			}
+		}
+	}
+	return
+}
+
+// Unload all instances. Waits for instances in use to be returned to the
+// pool.
+func (d *pooledDetector) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pool == nil {
+		return nil
+	}
+	for i := 0; i < d.loaded; i++ {
+		d.unload(<-d.pool)
+	}
+	d.pool = nil
+	return nil
+}
+
+// Create a face detector using the anime face cascade classifier embedded in
+// the binary. poolSize sets the maximum number of concurrent detections. If
+// poolSize <= 0, runtime.NumCPU() is used.
+//
+// Call Close() on the returned detector to free the loaded classifiers.
+func NewCascadeDetector(opts CascadeOptions, poolSize int,
+) (fd FaceDetector, err error) {
+	if poolSize <= 0 {
+		poolSize = runtime.NumCPU()
+	}
+	opts = opts.normalize()
+
+	// XXX: Not having the cascade file embedded into the binary would prevent
+	// go-getablity but the OpenCV CascadeClassifier requires a file path.
+	r, err := gzip.NewReader(bytes.NewReader(cascade_animeface))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile("", "*.xml")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		return
+	}
+
+	name := C.CString(tmp.Name())
+	defer C.free(unsafe.Pointer(name))
+	d, err := newPooledDetector(
+		poolSize,
+		func() unsafe.Pointer {
+			return C.cpli_load_classifier(name)
+		},
+		func(c unsafe.Pointer) {
+			C.cpli_unload_classifier(c)
+		},
+	)
+	if err != nil {
+		return
+	}
+
+	optsC := C.CascadeOptions{
+		scale_factor:  C.double(opts.ScaleFactor),
+		min_neighbors: C.int(opts.MinNeighbors),
+		min_size:      C.int(opts.MinSize),
+	}
+	d.detect = func(c unsafe.Pointer, path *C.char, out *C.FaceList,
+	) *C.char {
+		return C.cpli_detect_cascade(c, path, &optsC, out)
+	}
+	fd = d
+	return
+}
+
+// Create a face detector running a neural network model through the OpenCV
+// DNN module. The model must produce SSD-style detection output.
+// poolSize sets the maximum number of concurrent detections. If
+// poolSize <= 0, runtime.NumCPU() is used.
+//
+// Call Close() on the returned detector to free the loaded networks.
+func NewDNNDetector(opts DNNOptions, poolSize int,
+) (fd FaceDetector, err error) {
+	if opts.Model == "" {
+		err = Error{errors.New("no DNN model specified")}
+		return
+	}
+	if poolSize <= 0 {
+		poolSize = runtime.NumCPU()
+	}
+	opts = opts.normalize()
+
+	model := C.CString(opts.Model)
+	defer C.free(unsafe.Pointer(model))
+	config := C.CString(opts.Config)
+	defer C.free(unsafe.Pointer(config))
+	d, err := newPooledDetector(
+		poolSize,
+		func() unsafe.Pointer {
+			return C.cpli_load_dnn(model, config)
+		},
+		func(c unsafe.Pointer) {
+			C.cpli_unload_dnn(c)
+		},
+	)
+	if err != nil {
+		return
+	}
+
+	optsC := C.DNNOptions{
+		input_size:           C.int(opts.InputSize),
+		scale:                C.double(opts.Scale),
+		swap_rb:              C.bool(opts.SwapRB),
+		confidence_threshold: C.double(opts.ConfidenceThreshold),
+	}
+	for i, m := range opts.Mean {
+		optsC.mean[i] = C.double(m)
+	}
+	d.detect = func(c unsafe.Pointer, path *C.char, out *C.FaceList,
+	) *C.char {
+		return C.cpli_detect_dnn(c, path, &optsC, out)
+	}
+	fd = d
+	return
+}
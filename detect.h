@@ -0,0 +1,40 @@
+#pragma once
+#include <stdbool.h>
+#include <stddef.h>
+
+// Face bounding box with detector-specific confidence
+typedef struct {
+    int x, y, width, height;
+    double confidence;
+} Face;
+
+// Malloced array of detected faces
+typedef struct {
+    Face* faces;
+    size_t len;
+} FaceList;
+
+typedef struct {
+    double scale_factor;
+    int min_neighbors;
+    int min_size;
+} CascadeOptions;
+
+typedef struct {
+    int input_size;
+    double scale;
+    double mean[3];
+    bool swap_rb;
+    double confidence_threshold;
+} DNNOptions;
+
+void* cpli_load_classifier(const char* path);
+void cpli_unload_classifier(void* c);
+char* cpli_detect_cascade(void* classifier, const char* path,
+    const CascadeOptions* opts, FaceList* out);
+
+// config can be NULL or empty for model formats not requiring one
+void* cpli_load_dnn(const char* model, const char* config);
+void cpli_unload_dnn(void* net);
+char* cpli_detect_dnn(
+    void* net, const char* path, const DNNOptions* opts, FaceList* out);
@@ -1,53 +1,210 @@
+//go:build cgo && !nocv
+// +build cgo,!nocv
+
 #include "distort.hh"
 #include <algorithm>
 #include <array>
+#include <cmath>
 #include <functional>
 #include <random>
+#include <stdexcept>
+#include <vector>
+
+using Filter = std::function<void(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)>;
 
-using Filter
-    = std::function<void(cv::Mat& src, cv::Mat& dst, std::mt19937& rng)>;
+// Filter with its configured application probability and strength
+struct Stage {
+    Filter fn;
+    FilterOptions opts;
+};
 
-static int random_int(std::mt19937& rng, int min, int max)
+static int random_int(std::mt19937_64& rng, int min, int max)
 {
     std::uniform_int_distribution<> dis(min, max);
     return dis(rng);
 }
 
-static double random_double(std::mt19937& rng, double min, double max)
+static double random_double(std::mt19937_64& rng, double min, double max)
 {
     std::uniform_real_distribution<> dis(min, max);
     return dis(rng);
 }
 
-static void flip(cv::Mat& src, cv::Mat& dst, std::mt19937& rng)
+// Returns a random magnitude in the [strength/2; strength] range
+static double magnitude(std::mt19937_64& rng, double strength)
+{
+    return random_double(rng, 0.5, 1) * strength;
+}
+
+// Returns a random magnitude in the [strength/2; strength] range with a
+// random sign
+static double signed_magnitude(std::mt19937_64& rng, double strength)
+{
+    const double m = magnitude(rng, strength);
+    return random_int(rng, 0, 1) ? m : -m;
+}
+
+static void flip(cv::Mat& src, cv::Mat& dst, std::mt19937_64&, double)
+{
+    cv::flip(src, dst, 1);
+}
+
+static void gaussian_blur(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
+{
+    const double sigma = std::max(0.1, magnitude(rng, strength) * 2);
+    cv::GaussianBlur(src, dst, cv::Size(), sigma);
+}
+
+static void rotate(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
+{
+    const double angle = signed_magnitude(rng, strength) * 20;
+
+    // Scale up to keep the rotated image covering the entire frame
+    const double rad = std::abs(angle) * CV_PI / 180;
+    const double scale = std::cos(rad) + std::sin(rad);
+
+    const cv::Point2f center(src.cols / 2.0f, src.rows / 2.0f);
+    cv::warpAffine(src, dst, cv::getRotationMatrix2D(center, angle, scale),
+        src.size(), cv::INTER_LINEAR, cv::BORDER_REFLECT);
+}
+
+static void crop_jitter(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
+{
+    // Crop up to 15% of each dimension from each side
+    const int max_x = std::max(1, int(src.cols * strength * 0.15));
+    const int max_y = std::max(1, int(src.rows * strength * 0.15));
+    const int left = random_int(rng, 0, max_x);
+    const int right = random_int(rng, 0, max_x);
+    const int top = random_int(rng, 0, max_y);
+    const int bottom = random_int(rng, 0, max_y);
+
+    const cv::Rect r(
+        left, top, src.cols - left - right, src.rows - top - bottom);
+    cv::resize(cv::Mat(src, r), dst, src.size(), 0, 0, cv::INTER_LINEAR);
+}
+
+static void hue_shift(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
+{
+    // OpenCV stores 8 bit hue in the [0;180) range
+    const int shift = int(signed_magnitude(rng, strength) * 30);
+    const double saturation = 1 + signed_magnitude(rng, strength) * 0.5;
+
+    cv::Mat hsv;
+    cv::cvtColor(src, hsv, cv::COLOR_BGR2HSV);
+    for (int y = 0; y < hsv.rows; y++) {
+        auto row = hsv.ptr<cv::Vec3b>(y);
+        for (int x = 0; x < hsv.cols; x++) {
+            auto& p = row[x];
+            p[0] = (p[0] + shift + 180) % 180;
+            p[1] = cv::saturate_cast<uchar>(p[1] * saturation);
+        }
+    }
+    cv::cvtColor(hsv, dst, cv::COLOR_HSV2BGR);
+}
+
+static void noise(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
+{
+    std::normal_distribution<double> dis(
+        0, std::max(0.1, magnitude(rng, strength) * 25));
+
+    dst.create(src.size(), src.type());
+    for (int y = 0; y < src.rows; y++) {
+        const auto in = src.ptr<cv::Vec3b>(y);
+        auto out = dst.ptr<cv::Vec3b>(y);
+        for (int x = 0; x < src.cols; x++) {
+            for (int c = 0; c < 3; c++) {
+                out[x][c] = cv::saturate_cast<uchar>(in[x][c] + dis(rng));
+            }
+        }
+    }
+}
+
+static void jpeg_requantize(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
 {
-    if (random_int(rng, 0, 1)) {
-        cv::swap(src, dst);
-    } else {
-        cv::flip(src, dst, 1);
+    const int quality = 95 - int(magnitude(rng, strength) * 75);
+
+    std::vector<unsigned char> buf;
+    const std::vector<int> params = { cv::IMWRITE_JPEG_QUALITY, quality };
+    if (!cv::imencode(".jpg", src, buf, params)) {
+        throw std::runtime_error("could not re-encode image");
     }
+    dst = cv::imdecode(buf, cv::IMREAD_COLOR);
 }
 
-static void gaussian_blur(cv::Mat& src, cv::Mat& dst, std::mt19937& rng)
+static void perspective_warp(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
 {
-    cv::GaussianBlur(src, dst, cv::Size(), random_double(rng, 0.25, 0.5));
+    // Move each corner by up to 15% of the image dimensions
+    const float w = src.cols, h = src.rows;
+    const double d = std::max(1.0, w * strength * 0.15);
+    const cv::Point2f from[] = { { 0, 0 }, { w, 0 }, { w, h }, { 0, h } };
+    cv::Point2f to[4];
+    for (int i = 0; i < 4; i++) {
+        to[i] = from[i]
+            + cv::Point2f(float(random_double(rng, -d, d)),
+                float(random_double(rng, -d, d)));
+    }
+
+    cv::warpPerspective(src, dst, cv::getPerspectiveTransform(from, to),
+        src.size(), cv::INTER_LINEAR, cv::BORDER_REFLECT);
 }
 
-static const std::array<Filter, 2> filters = { flip, gaussian_blur };
+static void occlude(
+    cv::Mat& src, cv::Mat& dst, std::mt19937_64& rng, double strength)
+{
+    src.copyTo(dst);
+
+    // Shapes are up to a quarter of the image width in size
+    const int max_size = std::max(2, int(src.cols * strength * 0.25));
+    const int n = random_int(rng, 1, 3);
+    for (int i = 0; i < n; i++) {
+        const cv::Scalar colour(random_int(rng, 0, 255),
+            random_int(rng, 0, 255), random_int(rng, 0, 255));
+        const cv::Point center(
+            random_int(rng, 0, src.cols - 1), random_int(rng, 0, src.rows - 1));
+        const int size = random_int(rng, max_size / 2, max_size);
+        if (random_int(rng, 0, 1)) {
+            cv::circle(dst, center, size / 2, colour, cv::FILLED);
+        } else {
+            cv::rectangle(dst,
+                cv::Rect(center.x - size / 2, center.y - size / 2, size, size),
+                colour, cv::FILLED);
+        }
+    }
+}
 
-void cpli_distort_mat(cv::Mat& src, cv::Mat& dst)
+void cpli_distort_mat(cv::Mat& src, cv::Mat& dst, const DistortOptions& opts)
 {
-    std::random_device rd;
-    std::mt19937 rng(rd());
+    std::mt19937_64 rng(opts.seed);
 
     // Always keep the resulting Mat in dst and swap before a new operation
     auto swap = [&]() { cv::swap(src, dst); };
 
-    auto fil = filters;
-    std::shuffle(fil.begin(), fil.end(), rng);
+    std::array<Stage, 9> stages = { {
+        { flip, opts.flip },
+        { gaussian_blur, opts.blur },
+        { rotate, opts.rotate },
+        { crop_jitter, opts.crop },
+        { hue_shift, opts.hue },
+        { noise, opts.noise },
+        { jpeg_requantize, opts.jpeg },
+        { perspective_warp, opts.perspective },
+        { occlude, opts.occlude },
+    } };
+    std::shuffle(stages.begin(), stages.end(), rng);
     swap();
-    for (auto& f : fil) {
+    for (auto& s : stages) {
+        if (random_double(rng, 0, 1) >= s.opts.probability) {
+            continue;
+        }
         swap();
-        f(src, dst, rng);
+        s.fn(src, dst, rng, s.opts.strength);
     }
 }
@@ -0,0 +1,109 @@
+package captchouli
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Distortion and encoding applied to served thumbnails
+	distortion   = DefaultDistortion
+	output       = DefaultThumbnailOptions
+	distortionMu sync.RWMutex
+
+	// Semaphore limiting concurrent thumbnail distortion
+	distortWorkers atomic.Value
+)
+
+func init() {
+	setDistortWorkers(0)
+}
+
+// Probability and strength of a randomized thumbnail distortion filter
+type DistortionFilter struct {
+	// Probability of applying the filter to a thumbnail in the [0;1] range
+	Probability float64
+
+	// Strength of the filter in the [0;1] range. The effect of each filter at
+	// full strength is documented on the Distortion fields.
+	Strength float64
+}
+
+// Randomized distortions applied in random order to thumbnails to hinder
+// matching them against their source images
+type Distortion struct {
+	// Horizontal mirroring. Strength is ignored.
+	Flip DistortionFilter
+
+	// Gaussian blur with a sigma of up to 2
+	Blur DistortionFilter
+
+	// Rotation by up to 20 degrees
+	Rotate DistortionFilter
+
+	// Cropping of up to 15% from each side
+	Crop DistortionFilter
+
+	// Hue shift of up to 60 degrees and saturation change of up to 50%
+	Hue DistortionFilter
+
+	// Gaussian noise with a standard deviation of up to 25
+	Noise DistortionFilter
+
+	// JPEG re-encoding with a quality as low as 20
+	JPEG DistortionFilter
+
+	// Perspective warp moving each corner by up to 15% of the thumbnail size
+	Perspective DistortionFilter
+
+	// Up to 3 randomly coloured shapes of up to a quarter of the thumbnail
+	// size
+	Occlude DistortionFilter
+}
+
+// Distortion used, if none is specified in Options
+var DefaultDistortion = Distortion{
+	Flip:        DistortionFilter{0.5, 0},
+	Blur:        DistortionFilter{1, 0.25},
+	Rotate:      DistortionFilter{0.5, 0.4},
+	Crop:        DistortionFilter{0.5, 0.5},
+	Hue:         DistortionFilter{0.3, 0.3},
+	Noise:       DistortionFilter{0.3, 0.3},
+	JPEG:        DistortionFilter{0.5, 0.5},
+	Perspective: DistortionFilter{0.3, 0.3},
+
+	// Occluding parts of the face can make captchas harder to solve for
+	// humans, so this is opt-in
+	Occlude: DistortionFilter{0, 0.5},
+}
+
+// Set distortion applied to served thumbnails
+func setDistortion(d Distortion) {
+	distortionMu.Lock()
+	defer distortionMu.Unlock()
+	distortion = d
+}
+
+// Set size and encoding of generated and served thumbnails
+func setThumbnailOptions(o ThumbnailOptions) {
+	o = o.normalize()
+
+	distortionMu.Lock()
+	defer distortionMu.Unlock()
+	output = o
+}
+
+func getThumbnailOptions() ThumbnailOptions {
+	distortionMu.RLock()
+	defer distortionMu.RUnlock()
+	return output
+}
+
+// Set maximum number of thumbnails distorted concurrently
+func setDistortWorkers(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	distortWorkers.Store(make(chan struct{}, n))
+}
@@ -1,4 +1,7 @@
 #pragma once
+extern "C" {
+#include "thumbnail.h"
+}
 #include <opencv2/opencv.hpp>
 
-void cpli_distort_mat(cv::Mat& src, cv::Mat& dst);
+void cpli_distort_mat(cv::Mat& src, cv::Mat& dst, const DistortOptions& opts);
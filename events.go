@@ -0,0 +1,160 @@
+package captchouli
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/bakape/captchouli/v2/danbooru"
+	"github.com/bakape/captchouli/v2/db"
+)
+
+// Type of event passed to Options.OnEvent
+type EventType uint8
+
+const (
+	// Captcha was generated and written to a client
+	CaptchaIssued EventType = iota
+
+	// Captcha solution was checked and found correct
+	CaptchaSolved
+
+	// Captcha solution was checked and found incorrect or the captcha did not
+	// exist
+	CaptchaFailed
+
+	// Captcha was deleted by the database upkeep without being consumed
+	CaptchaExpired
+
+	// Solved status of the captcha was queried and the captcha deleted
+	CaptchaConsumed
+
+	// Image was downloaded, thumbnailed and added to the pool
+	ImageFetched
+
+	// Image was rejected and blacklisted. Emitted for fetched images failing
+	// the content filter, size limits or thumbnailing and for pooled images
+	// blacklisted by a changed content filter.
+	ImageBlacklisted
+
+	// Tag has enough images in its pool to be used for captchas
+	TagReady
+)
+
+func (t EventType) String() string {
+	switch t {
+	case CaptchaIssued:
+		return "captcha_issued"
+	case CaptchaSolved:
+		return "captcha_solved"
+	case CaptchaFailed:
+		return "captcha_failed"
+	case CaptchaExpired:
+		return "captcha_expired"
+	case CaptchaConsumed:
+		return "captcha_consumed"
+	case ImageFetched:
+		return "image_fetched"
+	case ImageBlacklisted:
+		return "image_blacklisted"
+	case TagReady:
+		return "tag_ready"
+	default:
+		return "unknown_event"
+	}
+}
+
+// Captcha lifecycle or image pool event
+type Event struct {
+	Type EventType
+
+	// Tag the captcha was generated for or the image was fetched for.
+	// Can be empty for CaptchaFailed events on nonexistent captchas and for
+	// ImageBlacklisted events of pooled images.
+	Tag string
+
+	// Captcha ID for captcha events
+	ID [64]byte
+
+	// Image MD5 hash for image events
+	MD5 [16]byte
+
+	// Outcome of a CaptchaConsumed event. True, if the captcha was solved.
+	Solved bool
+
+	// Client request that triggered the event, if the event was triggered
+	// through one of the HTTP handlers. Can be used to extract client
+	// metadata, such as addresses or session cookies.
+	Request *http.Request
+}
+
+// Registered Options.OnEvent handlers. The slice is replaced on every change
+// and never modified in place, so emit can call handlers without holding mu.
+var eventHandlers struct {
+	mu       sync.RWMutex
+	handlers []*eventHandler
+}
+
+// Registered event handler. Compared by pointer on unregistration, as
+// functions are not comparable.
+type eventHandler struct {
+	fn func(Event)
+}
+
+func init() {
+	db.OnExpire = func(id [64]byte, tag string) {
+		emit(Event{
+			Type: CaptchaExpired,
+			Tag:  tag,
+			ID:   id,
+		})
+	}
+	emitBlacklisted := func(md5 [16]byte, tag string) {
+		emit(Event{
+			Type: ImageBlacklisted,
+			Tag:  tag,
+			MD5:  md5,
+		})
+	}
+	db.OnBlacklist = emitBlacklisted
+	danbooru.OnBlacklist = emitBlacklisted
+}
+
+// Register fn to be called on all events. Call the returned function to
+// unregister it again.
+func registerEventHandler(fn func(Event)) (unregister func()) {
+	h := &eventHandler{fn}
+
+	eventHandlers.mu.Lock()
+	defer eventHandlers.mu.Unlock()
+
+	old := eventHandlers.handlers
+	handlers := make([]*eventHandler, len(old), len(old)+1)
+	copy(handlers, old)
+	eventHandlers.handlers = append(handlers, h)
+
+	return func() {
+		eventHandlers.mu.Lock()
+		defer eventHandlers.mu.Unlock()
+
+		old := eventHandlers.handlers
+		handlers := make([]*eventHandler, 0, len(old))
+		for _, o := range old {
+			if o != h {
+				handlers = append(handlers, o)
+			}
+		}
+		eventHandlers.handlers = handlers
+	}
+}
+
+// Pass event to all registered handlers
+func emit(e Event) {
+	eventHandlers.mu.RLock()
+	handlers := eventHandlers.handlers
+	eventHandlers.mu.RUnlock()
+
+	// Handlers may register or unregister handlers
+	for _, h := range handlers {
+		h.fn(e)
+	}
+}
@@ -0,0 +1,86 @@
+package captchouli
+
+import (
+	"testing"
+
+	"github.com/bakape/captchouli/v2/db"
+	"github.com/bakape/captchouli/v2/test_utils"
+)
+
+func TestFailedEvent(t *testing.T) {
+	var events []Event
+	defer registerEventHandler(func(e Event) {
+		if e.Type == CaptchaFailed {
+			events = append(events, e)
+		}
+	})()
+
+	var id [64]byte
+	id[0] = 1
+	err := CheckCaptcha(id, []byte{1, 2, 3})
+	if err != ErrInvalidSolution {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatal(events)
+	}
+	if e := events[0]; e.ID != id || e.Tag != "" || e.Request != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestUnregisterEventHandler(t *testing.T) {
+	var calls int
+	unregister := registerEventHandler(func(Event) {
+		calls++
+	})
+	unregisterOther := registerEventHandler(func(Event) {})
+	defer unregisterOther()
+
+	emit(Event{Type: CaptchaIssued})
+	unregister()
+	emit(Event{Type: CaptchaIssued})
+	if calls != 1 {
+		t.Fatalf("unexpected call count: %d", calls)
+	}
+}
+
+func TestRegisterEventHandlerFromHandler(t *testing.T) {
+	var unregister func()
+	defer func() {
+		if unregister != nil {
+			unregister()
+		}
+	}()
+	once := registerEventHandler(func(Event) {
+		if unregister == nil {
+			unregister = registerEventHandler(func(Event) {})
+		}
+	})
+	defer once()
+
+	emit(Event{Type: CaptchaIssued})
+	if unregister == nil {
+		t.Fatal("handler not registered")
+	}
+}
+
+func TestBlacklistedEvent(t *testing.T) {
+	tag := test_utils.RandomTag()
+	img, _ := insertPooled(t, 1, tag)
+
+	var events []Event
+	defer registerEventHandler(func(e Event) {
+		if e.Type == ImageBlacklisted {
+			events = append(events, e)
+		}
+	})()
+
+	_, err := db.BlacklistTagged([]string{tag}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].MD5 != img.MD5 || events[0].Tag != "" {
+		t.Fatalf("unexpected events: %v", events)
+	}
+}
@@ -0,0 +1,232 @@
+package captchouli
+
+import (
+	"image"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Face detector used for thumbnailing. Protected by detectorMu.
+	detector   FaceDetector
+	detectorMu sync.RWMutex
+
+	// Detector was created by initDetector and must be closed by it
+	ownDetector bool
+
+	// Set to 1, when a face detector is loaded. Allows checking without
+	// contending on detectorMu.
+	classifierReady int32
+)
+
+// Face detected in an image
+type Face struct {
+	// Bounding box of the face
+	image.Rectangle
+
+	// Detector-specific confidence of the detection. Only comparable between
+	// faces detected by the same detector.
+	Confidence float64
+}
+
+// Detects faces in images for thumbnail generation. Implementations must be
+// safe for concurrent use.
+type FaceDetector interface {
+	// Return all faces detected in the image file at path
+	Detect(path string) ([]Face, error)
+}
+
+// Parameters of the default cascade classifier face detector
+type CascadeOptions struct {
+	// Image scale reduction between detection passes. Defaults to 1.1.
+	ScaleFactor float64
+
+	// Number of neighbouring detections needed to retain a detection.
+	// Defaults to 5.
+	MinNeighbors int
+
+	// Minimum width and height of a face in pixels. Defaults to 50.
+	MinSize int
+}
+
+func (o CascadeOptions) normalize() CascadeOptions {
+	if o.ScaleFactor <= 1 {
+		o.ScaleFactor = 1.1
+	}
+	if o.MinNeighbors <= 0 {
+		o.MinNeighbors = 5
+	}
+	if o.MinSize <= 0 {
+		o.MinSize = 50
+	}
+	return o
+}
+
+// Parameters of a face detector backed by an OpenCV DNN module model with SSD
+// detection output, such as the OpenCV res10_300x300_ssd face detector
+type DNNOptions struct {
+	// Path to model weights in any format supported by cv::dnn::readNet, such
+	// as ONNX or Caffe
+	Model string
+
+	// Path to the model configuration, if the format requires one, such as a
+	// Caffe .prototxt file
+	Config string
+
+	// Width and height of the model input. Defaults to 300.
+	InputSize int
+
+	// Multiplier for pixel values. Defaults to 1.
+	Scale float64
+
+	// Mean BGR values subtracted from the image
+	Mean [3]float64
+
+	// Swap red and blue channels of the input
+	SwapRB bool
+
+	// Minimum confidence in the [0;1] range for a detection to be retained.
+	// Defaults to 0.5.
+	ConfidenceThreshold float64
+}
+
+func (o DNNOptions) normalize() DNNOptions {
+	if o.InputSize <= 0 {
+		o.InputSize = 300
+	}
+	if o.Scale == 0 {
+		o.Scale = 1
+	}
+	if o.ConfidenceThreshold <= 0 {
+		o.ConfidenceThreshold = 0.5
+	}
+	return o
+}
+
+// Controls how many thumbnails are cropped from a single source image. Each
+// crop is stored as a separate pool entry linked to the source image.
+type CropOptions struct {
+	// Maximum number of detected faces to crop, largest first. Defaults to 1.
+	MaxFaces int
+
+	// Scale factors of the crop around each face. A zoom of 1 crops the
+	// detected face tightly, higher values include more of the surroundings.
+	// Each zoom level produces a separate crop per face. Defaults to {1}.
+	Zoom []float64
+}
+
+var (
+	// Crops produced from newly fetched images
+	cropOptions   = CropOptions{}.normalize()
+	cropOptionsMu sync.RWMutex
+)
+
+func (o CropOptions) normalize() CropOptions {
+	if o.MaxFaces <= 0 {
+		o.MaxFaces = 1
+	}
+	zoom := make([]float64, 0, len(o.Zoom))
+	for _, z := range o.Zoom {
+		if z > 0 {
+			zoom = append(zoom, z)
+		}
+	}
+	if len(zoom) == 0 {
+		zoom = append(zoom, 1)
+	}
+	o.Zoom = zoom
+	return o
+}
+
+// Set crops produced from newly fetched images
+func setCropOptions(o CropOptions) {
+	o = o.normalize()
+
+	cropOptionsMu.Lock()
+	defer cropOptionsMu.Unlock()
+	cropOptions = o
+}
+
+func getCropOptions() CropOptions {
+	cropOptionsMu.RLock()
+	defer cropOptionsMu.RUnlock()
+	return cropOptions
+}
+
+// Undistorted thumbnail cropped from a source image
+type crop struct {
+	thumb   []byte
+	quality Quality
+	phash   uint64
+}
+
+// Sort faces by area, largest first
+func sortFaces(faces []Face) {
+	sort.SliceStable(faces, func(i, j int) bool {
+		a, b := faces[i].Size(), faces[j].Size()
+		return a.X*a.Y > b.X*b.Y
+	})
+}
+
+// Return, if a face detector is loaded
+func classifierLoaded() bool {
+	return atomic.LoadInt32(&classifierReady) == 1
+}
+
+// Return maximum number of concurrent face detections
+func detectorConcurrency() int {
+	detectorMu.RLock()
+	defer detectorMu.RUnlock()
+
+	if c, ok := detector.(interface{ Concurrency() int }); ok {
+		return c.Concurrency()
+	}
+	return runtime.NumCPU()
+}
+
+// Set the face detector used for thumbnailing. If fd is nil and no detector
+// is set, the default cascade classifier detector with a pool of n
+// classifiers is loaded.
+func initDetector(fd FaceDetector, opts CascadeOptions, n int) (err error) {
+	detectorMu.Lock()
+	defer detectorMu.Unlock()
+
+	if fd == nil {
+		if detector != nil {
+			return
+		}
+		fd, err = NewCascadeDetector(opts, n)
+		if err != nil {
+			return
+		}
+		ownDetector = true
+	} else {
+		if fd == detector {
+			return
+		}
+		closeDetectorLocked()
+	}
+	detector = fd
+	atomic.StoreInt32(&classifierReady, 1)
+	return
+}
+
+// Unload the face detector, if created by initDetector. Waits for running
+// detections to complete.
+func closeDetector() {
+	detectorMu.Lock()
+	defer detectorMu.Unlock()
+	closeDetectorLocked()
+}
+
+func closeDetectorLocked() {
+	atomic.StoreInt32(&classifierReady, 0)
+	if c, ok := detector.(io.Closer); ok && ownDetector {
+		c.Close()
+	}
+	detector = nil
+	ownDetector = false
+}
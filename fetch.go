@@ -1,9 +1,10 @@
 package captchouli
 
 import (
-	"log"
+	"encoding/hex"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bakape/captchouli/v2/common"
@@ -24,21 +25,25 @@ func init() {
 			select {
 			case req := <-scheduleFetch:
 				requests[req] = struct{}{} // Deduplicate request
+				atomic.StoreInt64(&stats.fetchQueueLength, int64(len(requests)))
 			case <-tick:
 				if len(requests) == 0 {
 					break
 				}
 
 				// Get random request
-				target := common.RandomInt(len(requests))
+				target := common.FetchRand.Int(len(requests))
 				i := 0
 				for req := range requests {
 					if i == target {
 						err := fetch(req)
 						if err != nil {
-							log.Printf("fetch error on tag `%s`\n", req.Tag)
+							common.LogError("fetch error", "tag", req.Tag,
+								"error", err)
 						}
 						delete(requests, req)
+						atomic.StoreInt64(&stats.fetchQueueLength,
+							int64(len(requests)))
 						break
 					}
 					i++
@@ -48,9 +53,24 @@ func init() {
 	}()
 }
 
+// Return number of fetch requests waiting to be processed
+func fetchBacklog() int {
+	return int(atomic.LoadInt64(&stats.fetchQueueLength)) + len(scheduleFetch)
+}
+
 func fetch(req common.FetchRequest) (err error) {
 	req.Tag = strings.ToLower(req.Tag)
 
+	var result string
+	defer func() {
+		if err != nil {
+			result = fetchFailure
+		}
+		if result != "" {
+			stats.fetches.Inc(req.Tag, result)
+		}
+	}()
+
 	f, img, err := danbooru.Fetch(req)
 	if f == nil || err != nil {
 		return
@@ -58,17 +78,101 @@ func fetch(req common.FetchRequest) (err error) {
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	thumb, err := thumbnail(f.Name())
+	md5 := hex.EncodeToString(img.MD5[:])
+	start := time.Now()
+	crops, err := thumbnails(f.Name())
+	took := time.Since(start)
+	stats.thumbnailDuration.Observe(took)
+
+	// Blacklist image, so it is not fetched again
+	reject := func(res, msg string, keyvals ...interface{}) (err error) {
+		result = res
+		common.LogDebug(msg, append([]interface{}{"tag", req.Tag, "md5", md5,
+			"source", img.Source, "duration", took}, keyvals...)...)
+		err = db.BlacklistImage(img.MD5)
+		if err != nil {
+			return
+		}
+		emit(Event{
+			Type: ImageBlacklisted,
+			Tag:  req.Tag,
+			MD5:  img.MD5,
+		})
+		return
+	}
+
 	switch err {
 	case nil:
 	case ErrNoFace:
-		return db.BlacklistImage(img.MD5)
+		return reject(fetchNoFace, "no faces detected")
 	default:
 		return
 	}
-	err = writeThumbnail(thumb, img.MD5)
+
+	// Remove written thumbnails, if the image is not inserted
+	defer func() {
+		if err != nil {
+			for _, c := range img.Crops {
+				os.Remove(common.ThumbPath(c.Hash))
+			}
+		}
+	}()
+
+	thresholds := getQualityThresholds()
+	var (
+		reason    string
+		duplicate [16]byte
+	)
+	for _, c := range crops {
+		if r := thresholds.check(c.quality); r != "" {
+			reason = r
+			continue
+		}
+		var (
+			dup   [16]byte
+			found bool
+		)
+		dup, found, err = db.FindDuplicate(c.phash)
+		if err != nil {
+			return
+		}
+		if found {
+			duplicate = dup
+			continue
+		}
+		crop := db.Crop{
+			Hash:     common.CropHash(img.MD5, len(img.Crops)),
+			Quality:  c.quality,
+			PHash:    c.phash,
+			HasPHash: true,
+		}
+		err = writeThumbnail(c.thumb, crop.Hash)
+		if err != nil {
+			return
+		}
+		img.Crops = append(img.Crops, crop)
+	}
+	switch {
+	case len(img.Crops) != 0:
+	case reason != "":
+		return reject(fetchLowQuality, "low quality face crop",
+			"reason", reason)
+	default:
+		return reject(fetchDuplicate, "near-duplicate of pooled image",
+			"duplicate", hex.EncodeToString(duplicate[:]))
+	}
+
+	err = db.InsertImage(img)
 	if err != nil {
 		return
 	}
-	return db.InsertImage(img)
+	result = fetchSuccess
+	common.LogDebug("image fetched", "tag", req.Tag, "md5", md5,
+		"source", img.Source, "duration", took, "crops", len(img.Crops))
+	emit(Event{
+		Type: ImageFetched,
+		Tag:  req.Tag,
+		MD5:  img.MD5,
+	})
+	return
 }
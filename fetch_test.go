@@ -9,7 +9,7 @@ import (
 func TestFetch(t *testing.T) {
 	newService(t)
 	err := fetch(common.FetchRequest{
-		Tag: "patchouli_knowledge",
+		Tag: testTags[0],
 	})
 	switch err {
 	case nil, ErrNoFace:
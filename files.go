@@ -1,34 +1,73 @@
 package captchouli
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/base64"
-	"os"
+	"io/ioutil"
 
 	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/templates"
 )
 
-func writeThumbnail(thumb []byte, md5 [16]byte) (err error) {
-	f, err := os.OpenFile(common.ThumbPath(md5),
-		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+// Prefix of thumbnails stored by older versions as pre-distorted data URIs
+var legacyThumbPrefix = []byte("data:image/jpeg;base64,")
+
+func writeThumbnail(thumb []byte, md5 [16]byte) error {
+	return ioutil.WriteFile(common.ThumbPath(md5), thumb, 0600)
+}
 
-	bio := bufio.NewWriter(f)
-	_, err = bio.WriteString(`data:image/jpeg;base64,`)
+// Read stored undistorted thumbnail
+func readThumbnail(md5 [16]byte) (thumb []byte, err error) {
+	thumb, err = ioutil.ReadFile(common.ThumbPath(md5))
 	if err != nil {
 		return
 	}
-	enc := base64.NewEncoder(base64.StdEncoding, bio)
-	_, err = enc.Write(thumb)
-	if err != nil {
-		return
+	if bytes.HasPrefix(thumb, legacyThumbPrefix) {
+		// Already distorted once at ingest, but distorting again still
+		// produces unique output on every use
+		src := thumb[len(legacyThumbPrefix):]
+		thumb = make([]byte, base64.StdEncoding.DecodedLen(len(src)))
+		var n int
+		n, err = base64.StdEncoding.Decode(thumb, src)
+		thumb = thumb[:n]
 	}
-	err = enc.Close()
-	if err != nil {
-		return
+	return
+}
+
+// Read and distort the thumbnails of all captcha images in parallel
+func distortThumbnails(images [9][16]byte,
+) (thumbs [9]templates.Thumbnail, err error) {
+	// Draw seeds in order, so distortions do not depend on goroutine
+	// scheduling
+	var seeds [9]int64
+	for i := range seeds {
+		seeds[i] = common.CaptchaRand.Int63()
+	}
+
+	var errs [9]error
+	done := make(chan struct{})
+	for i := range images {
+		go func(i int) {
+			defer func() {
+				done <- struct{}{}
+			}()
+
+			thumb, err := readThumbnail(images[i])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			thumbs[i], errs[i] = distort(thumb, seeds[i])
+		}(i)
+	}
+	for range images {
+		<-done
+	}
+
+	for _, err = range errs {
+		if err != nil {
+			return
+		}
 	}
-	return bio.Flush()
+	return
 }
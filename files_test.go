@@ -0,0 +1,31 @@
+package captchouli
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+
+	"github.com/bakape/captchouli/v2/common"
+)
+
+func TestReadLegacyThumbnail(t *testing.T) {
+	var md5 [16]byte
+	md5[0] = 0xff
+	std := []byte{1, 2, 3, 4, 5}
+
+	data := append([]byte(nil), legacyThumbPrefix...)
+	data = append(data, base64.StdEncoding.EncodeToString(std)...)
+	err := ioutil.WriteFile(common.ThumbPath(md5), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumb, err := readThumbnail(md5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(thumb, std) {
+		t.Fatal(thumb)
+	}
+}
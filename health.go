@@ -0,0 +1,144 @@
+package captchouli
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bakape/captchouli/v2/db"
+)
+
+const (
+	// Minimum number of tags with a full pool needed to generate captchas
+	minReadyTags = 3
+
+	// Default maximum fetch queue length for the service to be considered
+	// ready
+	defaultMaxFetchBacklog = 128
+)
+
+// Pool state of a single tag
+type TagStatus struct {
+	Tag string `json:"tag"`
+
+	// Usable images in the pool
+	Images int `json:"images"`
+
+	// Booru posts pending download
+	Pending int `json:"pending"`
+
+	// Tag has enough images to be used in captchas
+	Ready bool `json:"ready"`
+}
+
+// Detailed readiness state of a service
+type Readiness struct {
+	// Service is able to produce captchas
+	Ready bool `json:"ready"`
+
+	ClassifierLoaded bool `json:"classifier_loaded"`
+	ReadyTags        int  `json:"ready_tags"`
+	MinReadyTags     int  `json:"min_ready_tags"`
+	FetchBacklog     int  `json:"fetch_backlog"`
+	MaxFetchBacklog  int  `json:"max_fetch_backlog"`
+
+	// State of every configured tag
+	Tags []TagStatus `json:"tags"`
+}
+
+// Return readiness state of service and the image pools of all configured
+// tags. Only tags available for captcha generation with enough images in their
+// pool are ready.
+func (s *Service) Readiness() (re Readiness, err error) {
+	re = Readiness{
+		ClassifierLoaded: classifierLoaded(),
+		MinReadyTags:     minReadyTags,
+		FetchBacklog:     fetchBacklog(),
+		MaxFetchBacklog:  s.maxFetchBacklog,
+		Tags:             make([]TagStatus, len(s.allTags)),
+	}
+
+	// Image counts of tags available for captcha generation
+	available := make(map[string]int)
+	for _, tag := range s.tags.Get() {
+		var n int
+		n, err = db.ImageCount(s.filters(tag))
+		if err != nil {
+			return
+		}
+		available[tag] = n
+		if n >= poolMinSize {
+			re.ReadyTags++
+		}
+	}
+
+	for i, tag := range s.allTags {
+		t := &re.Tags[i]
+		t.Tag = tag
+		tag, _, err = db.ResolveTagAlias(tag)
+		if err != nil {
+			return
+		}
+		n, ok := available[tag]
+		if ok {
+			t.Images = n
+			t.Ready = n >= poolMinSize
+		} else {
+			t.Images, err = db.ImageCount(s.filters(tag))
+			if err != nil {
+				return
+			}
+		}
+		t.Pending, err = db.CountPending(tag)
+		if err != nil {
+			return
+		}
+	}
+	re.Ready = (re.ClassifierLoaded || s.serveOnly) &&
+		re.ReadyTags >= re.MinReadyTags &&
+		re.FetchBacklog < re.MaxFetchBacklog
+	return
+}
+
+// Serve process liveness status. Responds with 200, if the database is
+// reachable, and 503 otherwise.
+func ServeHealth(w http.ResponseWriter, r *http.Request) error {
+	res := struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	}{
+		OK: true,
+	}
+	if err := db.Ping(); err != nil {
+		res.OK = false
+		res.Error = err.Error()
+	}
+	return writeJSON(w, res.OK, res)
+}
+
+// Serve service readiness status with per-tag detail. Responds with 200, if
+// the service is able to produce captchas, and 503 otherwise.
+func (s *Service) ServeReady(w http.ResponseWriter, r *http.Request) error {
+	re, err := s.Readiness()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, re.Ready, re)
+}
+
+func writeJSON(w http.ResponseWriter, ok bool, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "no-store, private")
+	if ok {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,30 @@
+package captchouli
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	router := newService(t).Router()
+
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assertCode(t, w, 200)
+
+	r = httptest.NewRequest("GET", "/readyz", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assertCode(t, w, 200)
+
+	var re Readiness
+	err := json.Unmarshal(w.Body.Bytes(), &re)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.Ready || len(re.Tags) != 3 || re.ReadyTags != 3 {
+		t.Fatalf("%+v", re)
+	}
+}
@@ -0,0 +1,225 @@
+package captchouli
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bakape/captchouli/v2/db"
+)
+
+// Process-wide counters exposed in the Prometheus text exposition format
+var stats = struct {
+	captchasGenerated, captchasSolved, captchasFailed counterVec
+	fetches                                           counterVec
+	thumbnailDuration                                 histogram
+
+	// Number of distinct fetch requests waiting in the scheduler
+	fetchQueueLength int64
+
+	// Solutions submitted for nonexistent or already used captchas. Not
+	// partitioned by tag to prevent clients from creating series.
+	captchasUnknown uint64
+}{
+	thumbnailDuration: histogram{
+		buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	},
+}
+
+// Possible fetch outcomes recorded in the fetch counter
+const (
+	fetchSuccess    = "success"
+	fetchFailure    = "failure"
+	fetchNoFace     = "no_face"
+	fetchLowQuality = "low_quality"
+	fetchDuplicate  = "duplicate"
+)
+
+// Set of counters partitioned by a list of label values
+type counterVec struct {
+	mu sync.Mutex
+	m  map[string]uint64
+}
+
+// Increment counter for the passed label values
+func (c *counterVec) Inc(labels ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.m == nil {
+		c.m = make(map[string]uint64)
+	}
+	c.m[strings.Join(labels, "\x00")]++
+}
+
+// Write counter in exposition format
+func (c *counterVec) write(w *bufio.Writer, name, help string,
+	labels ...string,
+) {
+	writeHeader(w, name, help, "counter")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.m))
+	for k := range c.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeSample(w, name, labels, strings.Split(k, "\x00"), c.m[k])
+	}
+}
+
+// Cumulative histogram with fixed upper bucket bounds
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// Record an observed duration
+func (h *histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	v := d.Seconds()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w *bufio.Writer, name, help string) {
+	writeHeader(w, name, help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		writeSample(w, name+"_bucket", []string{"le"},
+			[]string{fmt.Sprint(b)}, n)
+	}
+	writeSample(w, name+"_bucket", []string{"le"}, []string{"+Inf"}, h.count)
+	writeSample(w, name+"_sum", nil, nil, h.sum)
+	writeSample(w, name+"_count", nil, nil, h.count)
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSample(w *bufio.Writer, name string, keys, values []string,
+	val interface{},
+) {
+	w.WriteString(name)
+	if len(keys) != 0 {
+		w.WriteByte('{')
+		for i, k := range keys {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, k, escapeLabel(values[i]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %v\n", val)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Serve service metrics in the Prometheus text exposition format.
+// Can be mounted on any router, such as a separate administration router.
+func (s *Service) ServeMetrics(w http.ResponseWriter, r *http.Request,
+) (err error) {
+	// Query the database before writing anything to be able to still respond
+	// with an error status
+	type imageCount struct {
+		tag    string
+		rating Rating
+		n      int
+	}
+	var (
+		tags    = s.tags.Get()
+		images  = make([]imageCount, 0, len(tags)*len(s.explicitness))
+		pending = make([]int, len(tags))
+	)
+	for i, tag := range tags {
+		f := s.filters(tag)
+		for _, r := range s.explicitness {
+			f.Explicitness = []Rating{r}
+			c := imageCount{
+				tag:    tag,
+				rating: r,
+			}
+			c.n, err = db.ImageCount(f)
+			if err != nil {
+				return
+			}
+			images = append(images, c)
+		}
+		pending[i], err = db.CountPending(tag)
+		if err != nil {
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+
+	stats.captchasGenerated.write(bw, "captchouli_captchas_generated_total",
+		"Captchas generated", "tag")
+	stats.captchasSolved.write(bw, "captchouli_captchas_solved_total",
+		"Captchas solved correctly", "tag")
+	stats.captchasFailed.write(bw, "captchouli_captchas_failed_total",
+		"Captchas solved incorrectly", "tag")
+	writeHeader(bw, "captchouli_captchas_unknown_total",
+		"Solutions submitted for nonexistent captchas", "counter")
+	writeSample(bw, "captchouli_captchas_unknown_total", nil, nil,
+		atomic.LoadUint64(&stats.captchasUnknown))
+
+	writeHeader(bw, "captchouli_images", "Usable images in pool", "gauge")
+	for _, c := range images {
+		writeSample(bw, "captchouli_images", []string{"tag", "rating"},
+			[]string{c.tag, c.rating.String()}, c.n)
+	}
+	writeHeader(bw, "captchouli_pending_images",
+		"Booru posts pending download", "gauge")
+	for i, tag := range tags {
+		writeSample(bw, "captchouli_pending_images", []string{"tag"},
+			[]string{tag}, pending[i])
+	}
+
+	stats.fetches.write(bw, "captchouli_fetches_total",
+		"Image fetches by outcome", "tag", "result")
+	stats.thumbnailDuration.write(bw,
+		"captchouli_thumbnail_duration_seconds",
+		"Time spent detecting faces and generating thumbnails")
+
+	writeHeader(bw, "captchouli_fetch_queue_length",
+		"Fetch requests waiting in the scheduler", "gauge")
+	writeSample(bw, "captchouli_fetch_queue_length", nil, nil, fetchBacklog())
+
+	return bw.Flush()
+}
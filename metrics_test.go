@@ -0,0 +1,65 @@
+package captchouli
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newService(t)
+	s.metrics = true
+	router := s.Router()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assertCode(t, w, 200)
+
+	r = httptest.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assertCode(t, w, 200)
+
+	body := w.Body.String()
+	for _, s := range [...]string{
+		"# TYPE captchouli_captchas_generated_total counter",
+		`captchouli_images{tag="` + testTags[1] + `",rating="general"}`,
+		`captchouli_pending_images{tag="` + testTags[1] + `"}`,
+		"captchouli_thumbnail_duration_seconds_count",
+		"captchouli_fetch_queue_length",
+		"captchouli_captchas_unknown_total",
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("`%s` not found in:\n%s", s, body)
+		}
+	}
+}
+
+func TestUnknownCaptchaMetrics(t *testing.T) {
+	before := atomic.LoadUint64(&stats.captchasUnknown)
+	var id [64]byte
+	id[0] = 2
+	err := CheckCaptcha(id, []byte{1, 2, 3})
+	if err != ErrInvalidSolution {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadUint64(&stats.captchasUnknown); n != before+1 {
+		t.Fatalf("unknown captcha not counted: %d", n)
+	}
+
+	stats.captchasFailed.mu.Lock()
+	_, ok := stats.captchasFailed.m[""]
+	stats.captchasFailed.mu.Unlock()
+	if ok {
+		t.Fatal("unknown captcha counted as failed")
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	const in, out = "a\"b\\c\n", `a\"b\\c\n`
+	if s := escapeLabel(in); s != out {
+		t.Fatal(s)
+	}
+}
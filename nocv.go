@@ -0,0 +1,535 @@
+//go:build !cgo || nocv
+// +build !cgo nocv
+
+package captchouli
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand"
+
+	"github.com/bakape/captchouli/v2/templates"
+)
+
+// Built without OpenCV. Images can not be ingested and captchas are served
+// from an image pool populated by a process built with OpenCV.
+const openCVEnabled = false
+
+// Requires OpenCV
+func NewCascadeDetector(opts CascadeOptions, poolSize int,
+) (FaceDetector, error) {
+	return nil, ErrNoOpenCV
+}
+
+// Requires OpenCV
+func NewDNNDetector(opts DNNOptions, poolSize int) (FaceDetector, error) {
+	return nil, ErrNoOpenCV
+}
+
+// Requires OpenCV
+func thumbnails(path string) ([]crop, error) {
+	return nil, ErrNoOpenCV
+}
+
+// Apply randomized distortion to a stored thumbnail and encode it in the
+// configured output format. Runs on a bounded pool of workers. The
+// distortions are determined by seed.
+//
+// WebP output is served as JPEG.
+func distort(thumb []byte, seed int64) (t templates.Thumbnail, err error) {
+	if len(thumb) == 0 {
+		err = Error{errors.New("empty thumbnail")}
+		return
+	}
+
+	sem := distortWorkers.Load().(chan struct{})
+	sem <- struct{}{}
+	defer func() {
+		<-sem
+	}()
+
+	distortionMu.RLock()
+	d := distortion
+	o := output
+	distortionMu.RUnlock()
+	if o.Format == WebP {
+		o.Format = JPEG
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		err = Error{err}
+		return
+	}
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	rng := rand.New(rand.NewSource(seed))
+	filters := [...]struct {
+		opts DistortionFilter
+		fn   func(*image.RGBA, *rand.Rand, float64) (*image.RGBA, error)
+	}{
+		{d.Flip, flipImage},
+		{d.Blur, gaussianBlur},
+		{d.Rotate, rotateImage},
+		{d.Crop, cropJitter},
+		{d.Hue, hueShift},
+		{d.Noise, addNoise},
+		{d.JPEG, jpegRequantize},
+		{d.Perspective, perspectiveWarp},
+		{d.Occlude, occlude},
+	}
+	rng.Shuffle(len(filters), func(i, j int) {
+		filters[i], filters[j] = filters[j], filters[i]
+	})
+	for _, f := range filters {
+		if rng.Float64() >= f.opts.Probability {
+			continue
+		}
+		img, err = f.fn(img, rng, clampUnit(f.opts.Strength))
+		if err != nil {
+			return
+		}
+	}
+
+	t.Data, err = encodeImage(resizeImage(img, o.Size), o)
+	if err != nil {
+		return
+	}
+	if o.HiDPI {
+		t.Data2x, err = encodeImage(resizeImage(img, o.Size*2), o)
+		if err != nil {
+			return
+		}
+	}
+	t.MIME = o.Format.MIME()
+	return
+}
+
+func clampUnit(f float64) float64 {
+	return math.Max(0, math.Min(1, f))
+}
+
+// Returns a random magnitude in the [strength/2; strength] range
+func magnitude(rng *rand.Rand, strength float64) float64 {
+	return (0.5 + rng.Float64()/2) * strength
+}
+
+// Returns a random magnitude in the [strength/2; strength] range with a random
+// sign
+func signedMagnitude(rng *rand.Rand, strength float64) float64 {
+	m := magnitude(rng, strength)
+	if rng.Intn(2) == 0 {
+		return -m
+	}
+	return m
+}
+
+func flipImage(img *image.RGBA, _ *rand.Rand, _ float64,
+) (*image.RGBA, error) {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.SetRGBA(b.Max.X-1-(x-b.Min.X), y, img.RGBAAt(x, y))
+		}
+	}
+	return dst, nil
+}
+
+// Crop up to 15% of each dimension from each side and scale back up
+func cropJitter(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	b := img.Bounds()
+	maxX := int(math.Max(1, float64(b.Dx())*strength*0.15))
+	maxY := int(math.Max(1, float64(b.Dy())*strength*0.15))
+	r := image.Rect(
+		b.Min.X+rng.Intn(maxX+1),
+		b.Min.Y+rng.Intn(maxY+1),
+		b.Max.X-rng.Intn(maxX+1),
+		b.Max.Y-rng.Intn(maxY+1),
+	)
+	return scaleImage(img.SubImage(r).(*image.RGBA), b.Dx(), b.Dy()), nil
+}
+
+func addNoise(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	sd := math.Max(0.1, magnitude(rng, strength)*25)
+	for i := range img.Pix {
+		if i%4 == 3 { // Alpha
+			continue
+		}
+		v := float64(img.Pix[i]) + rng.NormFloat64()*sd
+		img.Pix[i] = uint8(math.Max(0, math.Min(255, math.Round(v))))
+	}
+	return img, nil
+}
+
+func jpegRequantize(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	var w bytes.Buffer
+	err := jpeg.Encode(&w, img, &jpeg.Options{
+		Quality: 95 - int(magnitude(rng, strength)*75),
+	})
+	if err != nil {
+		return nil, err
+	}
+	dec, err := jpeg.Decode(&w)
+	if err != nil {
+		return nil, err
+	}
+	dst := image.NewRGBA(dec.Bounds())
+	draw.Draw(dst, dst.Bounds(), dec, dec.Bounds().Min, draw.Src)
+	return dst, nil
+}
+
+func gaussianBlur(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	sigma := math.Max(0.1, magnitude(rng, strength)*2)
+	r := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*r+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - r)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	// Separable horizontal and vertical passes
+	b := img.Bounds()
+	pass := func(src *image.RGBA, dx, dy int) *image.RGBA {
+		dst := image.NewRGBA(b)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				var px [4]float64
+				for i, k := range kernel {
+					sx := reflectCoord(x+(i-r)*dx, b.Dx())
+					sy := reflectCoord(y+(i-r)*dy, b.Dy())
+					c := src.RGBAAt(b.Min.X+sx, b.Min.Y+sy)
+					px[0] += float64(c.R) * k
+					px[1] += float64(c.G) * k
+					px[2] += float64(c.B) * k
+					px[3] += float64(c.A) * k
+				}
+				dst.SetRGBA(b.Min.X+x, b.Min.Y+y, roundRGBA(px))
+			}
+		}
+		return dst
+	}
+	return pass(pass(img, 1, 0), 0, 1), nil
+}
+
+// Rotate by up to 20 degrees and scale up to keep the rotated image covering
+// the entire frame
+func rotateImage(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	rad := signedMagnitude(rng, strength) * 20 * math.Pi / 180
+	scale := math.Cos(math.Abs(rad)) + math.Sin(math.Abs(rad))
+	sin, cos := math.Sin(rad)/scale, math.Cos(rad)/scale
+
+	b := img.Bounds()
+	cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+	return warpImage(img, func(x, y float64) (float64, float64) {
+		x -= cx
+		y -= cy
+		return cos*x - sin*y + cx, sin*x + cos*y + cy
+	}), nil
+}
+
+// Shift hue by up to 60 degrees and change saturation by up to 50%
+func hueShift(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	shift := signedMagnitude(rng, strength) * 60
+	saturation := 1 + signedMagnitude(rng, strength)*0.5
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r := float64(img.Pix[i]) / 255
+		g := float64(img.Pix[i+1]) / 255
+		b := float64(img.Pix[i+2]) / 255
+
+		// RGB to HSV
+		max := math.Max(r, math.Max(g, b))
+		min := math.Min(r, math.Min(g, b))
+		v, c := max, max-min
+		var h, s float64
+		if max != 0 {
+			s = c / max
+		}
+		switch {
+		case c == 0:
+		case max == r:
+			h = 60 * math.Mod((g-b)/c, 6)
+		case max == g:
+			h = 60 * ((b-r)/c + 2)
+		default:
+			h = 60 * ((r-g)/c + 4)
+		}
+
+		h = math.Mod(h+shift+360, 360)
+		s = math.Min(1, s*saturation)
+
+		// HSV to RGB
+		c = v * s
+		x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+		var rgb [3]float64
+		switch int(h / 60) {
+		case 0:
+			rgb = [3]float64{c, x, 0}
+		case 1:
+			rgb = [3]float64{x, c, 0}
+		case 2:
+			rgb = [3]float64{0, c, x}
+		case 3:
+			rgb = [3]float64{0, x, c}
+		case 4:
+			rgb = [3]float64{x, 0, c}
+		default:
+			rgb = [3]float64{c, 0, x}
+		}
+		for j := range rgb {
+			img.Pix[i+j] = uint8(math.Round((rgb[j] + v - c) * 255))
+		}
+	}
+	return img, nil
+}
+
+// Move each corner by up to 15% of the image dimensions
+func perspectiveWarp(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	d := math.Max(1, w*strength*0.15)
+	from := [4][2]float64{{0, 0}, {w, 0}, {w, h}, {0, h}}
+	var to [4][2]float64
+	for i, p := range from {
+		to[i] = [2]float64{
+			p[0] + (rng.Float64()*2-1)*d,
+			p[1] + (rng.Float64()*2-1)*d,
+		}
+	}
+
+	// Map output pixels back to the source image
+	m, ok := homography(to, from)
+	if !ok {
+		return img, nil
+	}
+	return warpImage(img, func(x, y float64) (float64, float64) {
+		z := m[6]*x + m[7]*y + 1
+		return (m[0]*x + m[1]*y + m[2]) / z, (m[3]*x + m[4]*y + m[5]) / z
+	}), nil
+}
+
+// Return the coefficients of the projective transformation mapping each point
+// of from to the point of to at the same index. ok is false, if the points are
+// degenerate.
+func homography(from, to [4][2]float64) (m [8]float64, ok bool) {
+	// Solve the 8x8 linear system with Gauss-Jordan elimination
+	var a [8][9]float64
+	for i := range from {
+		x, y := from[i][0], from[i][1]
+		u, v := to[i][0], to[i][1]
+		a[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u * x, -u * y, u}
+		a[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v * x, -v * y, v}
+	}
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			f := a[row][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+	for i := range m {
+		m[i] = a[i][8] / a[i][i]
+	}
+	ok = true
+	return
+}
+
+// Draw up to 3 randomly coloured circles or squares of up to a quarter of the
+// image width in size
+func occlude(img *image.RGBA, rng *rand.Rand, strength float64,
+) (*image.RGBA, error) {
+	b := img.Bounds()
+	maxSize := int(math.Max(2, float64(b.Dx())*strength*0.25))
+	n := 1 + rng.Intn(3)
+	for i := 0; i < n; i++ {
+		c := color.RGBA{
+			R: uint8(rng.Intn(256)),
+			G: uint8(rng.Intn(256)),
+			B: uint8(rng.Intn(256)),
+			A: 255,
+		}
+		cx := b.Min.X + rng.Intn(b.Dx())
+		cy := b.Min.Y + rng.Intn(b.Dy())
+		size := maxSize/2 + rng.Intn(maxSize-maxSize/2+1)
+		circle := rng.Intn(2) == 0
+		r := size / 2
+		area := image.Rect(cx-r, cy-r, cx-r+size, cy-r+size).Intersect(b)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				if circle && (x-cx)*(x-cx)+(y-cy)*(y-cy) > r*r {
+					continue
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return img, nil
+}
+
+// Create an image of the same size as img by sampling img at the coordinates
+// fn maps each output pixel center to. Samples outside of img are reflected
+// back at its borders.
+func warpImage(img *image.RGBA, fn func(x, y float64) (float64, float64),
+) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			sx, sy := fn(float64(x)+0.5, float64(y)+0.5)
+			sx -= 0.5
+			sy -= 0.5
+			x0, y0 := math.Floor(sx), math.Floor(sy)
+			wx, wy := sx-x0, sy-y0
+
+			var px [4]float64
+			for _, s := range [...]struct {
+				x, y int
+				w    float64
+			}{
+				{int(x0), int(y0), (1 - wx) * (1 - wy)},
+				{int(x0) + 1, int(y0), wx * (1 - wy)},
+				{int(x0), int(y0) + 1, (1 - wx) * wy},
+				{int(x0) + 1, int(y0) + 1, wx * wy},
+			} {
+				c := img.RGBAAt(b.Min.X+reflectCoord(s.x, b.Dx()),
+					b.Min.Y+reflectCoord(s.y, b.Dy()))
+				px[0] += float64(c.R) * s.w
+				px[1] += float64(c.G) * s.w
+				px[2] += float64(c.B) * s.w
+				px[3] += float64(c.A) * s.w
+			}
+			dst.SetRGBA(b.Min.X+x, b.Min.Y+y, roundRGBA(px))
+		}
+	}
+	return dst
+}
+
+// Reflect coordinate i into the [0;n) range, repeating the border pixels like
+// OpenCV's BORDER_REFLECT
+func reflectCoord(i, n int) int {
+	if n == 1 {
+		return 0
+	}
+	period := 2 * n
+	i %= period
+	if i < 0 {
+		i += period
+	}
+	if i >= n {
+		i = period - 1 - i
+	}
+	return i
+}
+
+// Round and clamp RGBA channel values
+func roundRGBA(px [4]float64) color.RGBA {
+	var c [4]uint8
+	for i, v := range px {
+		c[i] = uint8(math.Max(0, math.Min(255, math.Round(v))))
+	}
+	return color.RGBA{R: c[0], G: c[1], B: c[2], A: c[3]}
+}
+
+// Resize a square thumbnail to dim x dim
+func resizeImage(img *image.RGBA, dim int) *image.RGBA {
+	if b := img.Bounds(); b.Dx() == dim && b.Dy() == dim {
+		return img
+	}
+	return scaleImage(img, dim, dim)
+}
+
+// Scale image to w x h with bilinear interpolation
+func scaleImage(src *image.RGBA, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	b := src.Bounds()
+	sx := float64(b.Dx()) / float64(w)
+	sy := float64(b.Dy()) / float64(h)
+	for y := 0; y < h; y++ {
+		fy := math.Max(0, (float64(y)+0.5)*sy-0.5)
+		y0 := int(fy)
+		y1 := minInt(y0+1, b.Dy()-1)
+		wy := fy - float64(y0)
+		for x := 0; x < w; x++ {
+			fx := math.Max(0, (float64(x)+0.5)*sx-0.5)
+			x0 := int(fx)
+			x1 := minInt(x0+1, b.Dx()-1)
+			wx := fx - float64(x0)
+
+			var px [4]float64
+			for _, s := range [...]struct {
+				x, y int
+				w    float64
+			}{
+				{x0, y0, (1 - wx) * (1 - wy)},
+				{x1, y0, wx * (1 - wy)},
+				{x0, y1, (1 - wx) * wy},
+				{x1, y1, wx * wy},
+			} {
+				c := src.RGBAAt(b.Min.X+s.x, b.Min.Y+s.y)
+				px[0] += float64(c.R) * s.w
+				px[1] += float64(c.G) * s.w
+				px[2] += float64(c.B) * s.w
+				px[3] += float64(c.A) * s.w
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(math.Round(px[0])),
+				G: uint8(math.Round(px[1])),
+				B: uint8(math.Round(px[2])),
+				A: uint8(math.Round(px[3])),
+			})
+		}
+	}
+	return dst
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func encodeImage(img image.Image, o ThumbnailOptions) ([]byte, error) {
+	var w bytes.Buffer
+	var err error
+	switch o.Format {
+	case PNG:
+		err = png.Encode(&w, img)
+	default:
+		err = jpeg.Encode(&w, img, &jpeg.Options{Quality: o.Quality})
+	}
+	return w.Bytes(), err
+}
@@ -0,0 +1,212 @@
+//go:build !cgo || nocv
+// +build !cgo nocv
+
+package captchouli
+
+import (
+	"bytes"
+	cryptoRand "crypto/rand"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/templates"
+)
+
+func TestPureGoDistortion(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 300, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 300; x++ {
+			src.SetRGBA(x, y, color.RGBA{
+				R: uint8(x),
+				G: uint8(y),
+				B: uint8(x + y),
+				A: 255,
+			})
+		}
+	}
+	var w bytes.Buffer
+	err := png.Encode(&w, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := DistortionFilter{1, 1}
+	setDistortion(Distortion{
+		Flip:        full,
+		Blur:        full,
+		Rotate:      full,
+		Crop:        full,
+		Hue:         full,
+		Noise:       full,
+		JPEG:        full,
+		Perspective: full,
+		Occlude:     full,
+	})
+	defer setDistortion(DefaultDistortion)
+	setThumbnailOptions(ThumbnailOptions{
+		HiDPI:  true,
+		Format: WebP,
+	})
+	defer setThumbnailOptions(DefaultThumbnailOptions)
+
+	thumb, err := distort(w.Bytes(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumb.MIME != "image/jpeg" {
+		t.Fatal(thumb.MIME)
+	}
+	for _, c := range [...]struct {
+		data []byte
+		dim  int
+	}{
+		{thumb.Data, 150},
+		{thumb.Data2x, 300},
+	} {
+		conf, format, err := image.DecodeConfig(bytes.NewReader(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != "jpeg" || conf.Width != c.dim || conf.Height != c.dim {
+			t.Fatalf("unexpected output: %s %dx%d", format, conf.Width,
+				conf.Height)
+		}
+	}
+}
+
+func TestDistortionFilters(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			src.SetRGBA(x, y, color.RGBA{
+				R: uint8(x * 4),
+				G: uint8(y * 4),
+				B: 128,
+				A: 255,
+			})
+		}
+	}
+
+	cases := [...]struct {
+		name string
+		fn   func(*image.RGBA, *rand.Rand, float64) (*image.RGBA, error)
+	}{
+		{"blur", gaussianBlur},
+		{"rotate", rotateImage},
+		{"hue", hueShift},
+		{"perspective", perspectiveWarp},
+		{"occlude", occlude},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			img := image.NewRGBA(src.Bounds())
+			copy(img.Pix, src.Pix)
+			dst, err := c.fn(img, rand.New(rand.NewSource(1)), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst.Bounds() != src.Bounds() {
+				t.Fatalf("unexpected bounds: %v", dst.Bounds())
+			}
+			if bytes.Equal(dst.Pix, src.Pix) {
+				t.Fatal("image not distorted")
+			}
+		})
+	}
+}
+
+func TestHomography(t *testing.T) {
+	from := [4][2]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	to := [4][2]float64{{1, 2}, {12, 1}, {9, 11}, {-1, 9}}
+	m, ok := homography(from, to)
+	if !ok {
+		t.Fatal("degenerate points")
+	}
+	for i, p := range from {
+		x, y := p[0], p[1]
+		z := m[6]*x + m[7]*y + 1
+		u, v := (m[0]*x+m[1]*y+m[2])/z, (m[3]*x+m[4]*y+m[5])/z
+		if math.Abs(u-to[i][0]) > 1e-9 || math.Abs(v-to[i][1]) > 1e-9 {
+			t.Fatalf("point %d mapped to %f,%f", i, u, v)
+		}
+	}
+}
+
+func TestReflectCoord(t *testing.T) {
+	for _, c := range [...]struct{ i, n, res int }{
+		{0, 4, 0},
+		{3, 4, 3},
+		{4, 4, 3},
+		{5, 4, 2},
+		{-1, 4, 0},
+		{-2, 4, 1},
+		{9, 4, 1},
+		{-5, 1, 0},
+	} {
+		if r := reflectCoord(c.i, c.n); r != c.res {
+			t.Errorf("reflectCoord(%d, %d) = %d; expected %d", c.i, c.n, r,
+				c.res)
+		}
+	}
+}
+
+func TestReproducibleDistortion(t *testing.T) {
+	var images [9][16]byte
+	for i := range images {
+		_, err := cryptoRand.Read(images[i][:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := image.NewRGBA(image.Rect(0, 0, 150, 150))
+		for y := 0; y < 150; y++ {
+			for x := 0; x < 150; x++ {
+				src.SetRGBA(x, y, color.RGBA{
+					R: uint8(x * y),
+					G: uint8(y + i),
+					B: uint8(x),
+					A: 255,
+				})
+			}
+		}
+		var w bytes.Buffer
+		err = png.Encode(&w, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeThumbnail(w.Bytes(), images[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	half := DistortionFilter{0.5, 1}
+	setDistortion(Distortion{
+		Flip:  half,
+		Crop:  half,
+		Noise: half,
+		JPEG:  half,
+	})
+	defer setDistortion(DefaultDistortion)
+	defer common.SetRandomSource(nil)
+
+	var thumbs [2][9]templates.Thumbnail
+	for i := range thumbs {
+		common.SetRandomSource(rand.NewSource(1))
+		var err error
+		thumbs[i], err = distortThumbnails(images)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range images {
+		if !bytes.Equal(thumbs[0][i].Data, thumbs[1][i].Data) {
+			t.Fatalf("distortions of image %d differ", i)
+		}
+	}
+}
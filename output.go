@@ -0,0 +1,79 @@
+package captchouli
+
+// Image format of served thumbnails
+type ThumbnailFormat uint8
+
+const (
+	JPEG ThumbnailFormat = iota
+	PNG
+	WebP
+)
+
+// Return MIME type of format
+func (f ThumbnailFormat) MIME() string {
+	switch f {
+	case PNG:
+		return "image/png"
+	case WebP:
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+func (f ThumbnailFormat) String() string {
+	switch f {
+	case PNG:
+		return "png"
+	case WebP:
+		return "webp"
+	default:
+		return "jpeg"
+	}
+}
+
+// Size and encoding of served thumbnails
+type ThumbnailOptions struct {
+	// Width and height of thumbnails in pixels. Defaults to 150.
+	Size int
+
+	// Also serve a variant with double the size for high-density screens.
+	// Images ingested with this enabled are stored at double the size.
+	HiDPI bool
+
+	// Image format. Defaults to JPEG. WebP requires OpenCV to be built with
+	// WebP support.
+	Format ThumbnailFormat
+
+	// Encoding quality in the [1;100] range. Ignored for PNG. Defaults to 85.
+	Quality int
+}
+
+// Thumbnail options used, if none are specified in Options
+var DefaultThumbnailOptions = ThumbnailOptions{
+	Size:    150,
+	Format:  JPEG,
+	Quality: 85,
+}
+
+// Fill in defaults for unset fields and clamp invalid values
+func (o ThumbnailOptions) normalize() ThumbnailOptions {
+	if o.Size <= 0 {
+		o.Size = DefaultThumbnailOptions.Size
+	}
+	switch {
+	case o.Quality <= 0:
+		o.Quality = DefaultThumbnailOptions.Quality
+	case o.Quality > 100:
+		o.Quality = 100
+	}
+	return o
+}
+
+// Return size of stored undistorted thumbnails
+func (o ThumbnailOptions) storedSize() int {
+	if o.HiDPI {
+		return o.Size * 2
+	}
+	return o.Size
+}
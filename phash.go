@@ -0,0 +1,110 @@
+package captchouli
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	_ "image/jpeg" // Legacy thumbnails
+	_ "image/png"
+	"sync"
+
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+)
+
+// Maximum Hamming distance between the perceptual hashes of two images for
+// them to be considered near-duplicates, if none is set
+const DefaultDuplicateDistance = 10
+
+// Ensures legacy images are only hashed once per process
+var backfillOnce sync.Once
+
+// Compute the 64 bit difference hash of an encoded image. Resized, re-encoded
+// and slightly edited copies of an image produce hashes with a small Hamming
+// distance.
+func perceptualHash(img []byte) (hash uint64, err error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		err = Error{err}
+		return
+	}
+
+	// Average luminance over a 9x8 grid
+	var grid [8][9]float64
+	b := src.Bounds()
+	for y := 0; y < 8; y++ {
+		y0 := b.Min.Y + y*b.Dy()/8
+		y1 := b.Min.Y + (y+1)*b.Dy()/8
+		for x := 0; x < 9; x++ {
+			x0 := b.Min.X + x*b.Dx()/9
+			x1 := b.Min.X + (x+1)*b.Dx()/9
+			var sum, n float64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, bl, _ := src.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) +
+						0.114*float64(bl)
+					n++
+				}
+			}
+			if n != 0 {
+				grid[y][x] = sum / n
+			}
+		}
+	}
+
+	// Set a bit for each cell brighter than its right neighbour
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if grid[y][x] > grid[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return
+}
+
+// Set maximum Hamming distance between perceptual hashes of near-duplicate
+// images. nil sets DefaultDuplicateDistance.
+func setDuplicateDistance(d *int) {
+	if d == nil {
+		db.SetDuplicateDistance(DefaultDuplicateDistance)
+	} else {
+		db.SetDuplicateDistance(*d)
+	}
+}
+
+// Compute and store perceptual hashes of images ingested before they were
+// recorded
+func backfillPerceptualHashes() (err error) {
+	crops, err := db.GetUnhashedImages()
+	if err != nil || len(crops) == 0 {
+		return
+	}
+
+	common.LogInfo("computing perceptual hashes of existing images",
+		"images", len(crops))
+	for _, md5 := range crops {
+		var (
+			thumb []byte
+			hash  uint64
+		)
+		thumb, err = readThumbnail(md5)
+		if err == nil {
+			hash, err = perceptualHash(thumb)
+		}
+		if err != nil {
+			// Don't abort on a single missing or corrupt thumbnail
+			common.LogWarn("could not compute perceptual hash",
+				"md5", hex.EncodeToString(md5[:]), "error", err)
+			err = nil
+			continue
+		}
+		err = db.SetPerceptualHash(md5, hash)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
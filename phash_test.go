@@ -0,0 +1,56 @@
+package captchouli
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"testing"
+)
+
+func TestPerceptualHash(t *testing.T) {
+	gradient := func(size int, invert bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, size, size))
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				v := uint8((x*x + y*3) * 255 / (size*size + size*3))
+				if invert {
+					v = 255 - v
+				}
+				img.SetGray(x, y, color.Gray{Y: v})
+			}
+		}
+		return img
+	}
+	hash := func(img image.Image, useJPEG bool) uint64 {
+		t.Helper()
+
+		var (
+			w   bytes.Buffer
+			err error
+		)
+		if useJPEG {
+			err = jpeg.Encode(&w, img, &jpeg.Options{Quality: 30})
+		} else {
+			err = png.Encode(&w, img)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := perceptualHash(w.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	orig := hash(gradient(300, false), false)
+	if d := bits.OnesCount64(orig ^ hash(gradient(150, false), true)); d > 4 {
+		t.Fatalf("resized copy too distant: %d", d)
+	}
+	if d := bits.OnesCount64(orig ^ hash(gradient(300, true), false)); d < 32 {
+		t.Fatalf("different image too close: %d", d)
+	}
+}
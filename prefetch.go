@@ -0,0 +1,191 @@
+package captchouli
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+)
+
+const (
+	// Number of images fetched for each tag by Prefetch, if none is set
+	DefaultPrefetchTarget = 100
+
+	// Number of consecutive fetches adding no images to the pool of a tag,
+	// after which Prefetch considers the tag exhausted
+	maxIdlePrefetches = 20
+)
+
+// Options for populating image pools with Prefetch
+type PrefetchOptions struct {
+	// Number of images to populate the pool of each tag with. Defaults to
+	// DefaultPrefetchTarget.
+	Target int
+
+	// Number of tags prefetched in parallel. Defaults to the concurrency of
+	// the face detector.
+	Workers int
+
+	// Called after each image fetch and once a tag is done. Calls are
+	// serialized and must not block for long.
+	Progress func(PrefetchProgress)
+}
+
+// Progress of populating the image pool of a tag
+type PrefetchProgress struct {
+	Tag string
+
+	// Number of images in the pool of the tag and the number to populate it
+	// with
+	Images, Target int
+
+	// Number of image fetches performed for the tag
+	Fetches int
+
+	// The tag will not be fetched any further
+	Done bool
+
+	// Danbooru has no more images matching the tag or fetches stopped adding
+	// images to the pool. The pool of the tag might be smaller than Target.
+	Exhausted bool
+
+	// Error, that stopped fetching of the tag
+	Err error
+
+	// Number of done tags and total number of tags
+	TagsDone, Tags int
+}
+
+// Populate the image pools of all tags in opts.Tags with p.Target images each
+// without starting a service. Use to build a populated data directory ahead
+// of deployment. Requires Open to have been called.
+//
+// Prefetching can be interrupted at any time and resumed by calling Prefetch
+// again. Tags with enough images are skipped and already fetched Danbooru
+// pages are not fetched again.
+//
+// Fetching a tag stops on the first error. Other tags continue to be fetched
+// and an error is returned after all tags are done.
+func Prefetch(opts Options, p PrefetchOptions) (err error) {
+	if len(opts.Tags) == 0 {
+		return Error{errors.New("no tags to prefetch")}
+	}
+	if opts.ServeOnly || !openCVEnabled {
+		return Error{errors.New("prefetching requires OpenCV")}
+	}
+
+	s, err := configure(opts)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	if p.Target <= 0 {
+		p.Target = DefaultPrefetchTarget
+	}
+	if p.Workers <= 0 {
+		p.Workers = detectorConcurrency()
+	}
+	if p.Workers > len(opts.Tags) {
+		p.Workers = len(opts.Tags)
+	}
+
+	var (
+		mu           sync.Mutex
+		done, failed int
+	)
+	report := func(pr PrefetchProgress) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if pr.Done {
+			done++
+			if pr.Err != nil {
+				failed++
+			}
+		}
+		pr.TagsDone = done
+		pr.Tags = len(opts.Tags)
+		if p.Progress != nil {
+			p.Progress(pr)
+		}
+	}
+
+	src := make(chan string, len(opts.Tags))
+	for _, tag := range opts.Tags {
+		src <- tag
+	}
+	close(src)
+	var wg sync.WaitGroup
+	wg.Add(p.Workers)
+	for i := 0; i < p.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for tag := range src {
+				s.prefetchTag(s.resolveTag(tag), p.Target, report)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed != 0 {
+		err = Error{fmt.Errorf("prefetching failed for %d of %d tags",
+			failed, len(opts.Tags))}
+	}
+	return
+}
+
+// Fetch images for tag, until its pool has target images or Danbooru has no
+// more matching images. Fetches rejecting all images, like near-duplicates or
+// images without faces, do not count as progress.
+func (s *Service) prefetchTag(tag string, target int,
+	report func(PrefetchProgress),
+) {
+	var (
+		err        error
+		prev, idle int
+		f          = s.filters(tag)
+		pr         = PrefetchProgress{
+			Tag:    tag,
+			Target: target,
+		}
+	)
+	for {
+		pr.Images, err = db.ImageCount(f)
+		if err != nil || pr.Images >= target {
+			break
+		}
+		if pr.Fetches != 0 {
+			if pr.Images > prev {
+				idle = 0
+			} else {
+				idle++
+				if idle >= maxIdlePrefetches {
+					pr.Exhausted = true
+					break
+				}
+			}
+			report(pr)
+		}
+		prev = pr.Images
+
+		pr.Fetches++
+		err = fetch(f.FetchRequest)
+		if err == common.ErrNoMatch {
+			pr.Exhausted = true
+			pr.Images, err = db.ImageCount(f)
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	pr.Done = true
+	pr.Err = err
+	if err != nil {
+		common.LogError("prefetch error", "tag", tag, "error", err)
+	}
+	report(pr)
+}
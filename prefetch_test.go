@@ -0,0 +1,65 @@
+package captchouli
+
+import (
+	"testing"
+
+	"github.com/bakape/captchouli/v2/test_utils"
+)
+
+func TestPrefetch(t *testing.T) {
+	full, scarce := test_utils.RandomTag(), test_utils.RandomTag()
+	booru.AddTag(full, 10)
+	booru.AddTag(scarce, 2)
+
+	final := make(map[string]PrefetchProgress)
+	prefetch := func() error {
+		return Prefetch(
+			Options{
+				Tags: []string{full, scarce},
+				Danbooru: DanbooruOptions{
+					BaseURL:   booru.URL,
+					RateLimit: 1000,
+				},
+				DuplicateDistance: &noDuplicateDetection,
+			},
+			PrefetchOptions{
+				Target:  8,
+				Workers: 2,
+				Progress: func(p PrefetchProgress) {
+					if p.Done {
+						final[p.Tag] = p
+					}
+				},
+			},
+		)
+	}
+
+	err := prefetch()
+	if !openCVEnabled {
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(final) != 2 {
+		t.Fatalf("not all tags done: %v", final)
+	}
+	if p := final[full]; p.Images < 8 || p.Exhausted || p.TagsDone > 2 {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+	if p := final[scarce]; p.Images > 2 || !p.Exhausted {
+		t.Fatalf("unexpected progress: %+v", p)
+	}
+
+	// Resumed prefetches skip populated tags
+	err = prefetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := final[full]; p.Fetches != 0 || p.Images < 8 {
+		t.Fatalf("populated tag fetched again: %+v", p)
+	}
+}
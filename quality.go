@@ -0,0 +1,80 @@
+package captchouli
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bakape/captchouli/v2/common"
+)
+
+// Quality metrics of a face crop
+type Quality = common.Quality
+
+// Minimum quality metrics of a face crop for it to be used in captchas.
+// Crops not meeting any of the thresholds are blacklisted. Zero values
+// disable the respective check.
+type QualityThresholds struct {
+	// Minimum side of the square crop in source image pixels. Smaller crops
+	// are upscaled to the thumbnail size and appear blurry.
+	MinFaceSize int
+
+	// Minimum crop area relative to the source image area in the [0;1] range
+	MinRelativeSize float64
+
+	// Minimum variance of the Laplacian of the crop luminance
+	MinSharpness float64
+
+	// Minimum standard deviation of the crop luminance in the [0;255] range
+	MinContrast float64
+
+	// Minimum detector confidence. Only meaningful for a specific detector.
+	MinConfidence float64
+
+	// Minimum ratio of the shorter to the longer side of the detected face in
+	// the [0;1] range
+	MinAspect float64
+}
+
+var (
+	// Thresholds applied to newly fetched images
+	qualityThresholds   QualityThresholds
+	qualityThresholdsMu sync.RWMutex
+)
+
+// Set thresholds applied to newly fetched images
+func setQualityThresholds(t QualityThresholds) {
+	qualityThresholdsMu.Lock()
+	defer qualityThresholdsMu.Unlock()
+	qualityThresholds = t
+}
+
+func getQualityThresholds() QualityThresholds {
+	qualityThresholdsMu.RLock()
+	defer qualityThresholdsMu.RUnlock()
+	return qualityThresholds
+}
+
+// Return the reason q does not meet the thresholds or an empty string, if it
+// does
+func (t QualityThresholds) check(q Quality) string {
+	fail := func(metric string, val, min interface{}) string {
+		return fmt.Sprintf("%s %v below %v", metric, val, min)
+	}
+
+	switch {
+	case q.FaceSize < t.MinFaceSize:
+		return fail("face size", q.FaceSize, t.MinFaceSize)
+	case q.RelativeSize < t.MinRelativeSize:
+		return fail("relative size", q.RelativeSize, t.MinRelativeSize)
+	case q.Sharpness < t.MinSharpness:
+		return fail("sharpness", q.Sharpness, t.MinSharpness)
+	case q.Contrast < t.MinContrast:
+		return fail("contrast", q.Contrast, t.MinContrast)
+	case q.Confidence < t.MinConfidence:
+		return fail("confidence", q.Confidence, t.MinConfidence)
+	case q.Aspect < t.MinAspect:
+		return fail("aspect", q.Aspect, t.MinAspect)
+	default:
+		return ""
+	}
+}
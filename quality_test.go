@@ -0,0 +1,41 @@
+package captchouli
+
+import "testing"
+
+func TestQualityThresholds(t *testing.T) {
+	q := Quality{
+		FaceSize:     100,
+		RelativeSize: 0.1,
+		Sharpness:    200,
+		Contrast:     40,
+		Confidence:   0.9,
+		Aspect:       1,
+	}
+
+	cases := [...]struct {
+		name      string
+		threshold QualityThresholds
+		pass      bool
+	}{
+		{"disabled", QualityThresholds{}, true},
+		{"all met", QualityThresholds{100, 0.1, 200, 40, 0.9, 1}, true},
+		{"face size", QualityThresholds{MinFaceSize: 101}, false},
+		{"relative size", QualityThresholds{MinRelativeSize: 0.2}, false},
+		{"sharpness", QualityThresholds{MinSharpness: 300}, false},
+		{"contrast", QualityThresholds{MinContrast: 41}, false},
+		{"confidence", QualityThresholds{MinConfidence: 0.95}, false},
+		{"aspect", QualityThresholds{MinAspect: 1.1}, false},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			reason := c.threshold.check(q)
+			if (reason == "") != c.pass {
+				t.Fatalf("unexpected result: %q", reason)
+			}
+		})
+	}
+}
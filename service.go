@@ -7,14 +7,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bakape/boorufetch"
 	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/danbooru"
 	"github.com/bakape/captchouli/v2/db"
 	"github.com/bakape/captchouli/v2/templates"
 	"github.com/julienschmidt/httprouter"
@@ -34,6 +36,9 @@ var (
 	// Captcha ID is of invalid format
 	ErrInvalidID = Error{errors.New("invalid captcha id")}
 
+	// Not enough tags have initialized image pools to generate captchas yet
+	ErrNotReady = Error{errors.New("service warming up")}
+
 	// Prebuilt and cached
 	solutionIDs [9]string
 )
@@ -66,29 +71,192 @@ const (
 	Explicit
 )
 
+// Strategy for selecting images not matching the captcha tag
+type DistractorStrategy = common.DistractorStrategy
+
+const (
+	RandomDistractors  = common.RandomDistractors
+	SimilarDistractors = common.SimilarDistractors
+)
+
+// Selection of images not matching the captcha tag
+type Distractors = common.Distractors
+
+// Danbooru API client settings
+type DanbooruOptions = danbooru.Options
+
+// Tags compared by SimilarDistractors, if none are set
+var DefaultDistractorTags = []string{"*_hair", "*_eyes"}
+
+// Receives structured log messages
+type Logger = common.Logger
+
+// Severity of a log message
+type LogLevel = common.LogLevel
+
+const (
+	LevelDebug = common.LevelDebug
+	LevelInfo  = common.LevelInfo
+	LevelWarn  = common.LevelWarn
+	LevelError = common.LevelError
+)
+
+// Create a Logger, that writes messages at or above min to w in logfmt
+// format. If w is nil, the standard library's default logger is used.
+func NewLogger(w io.Writer, min LogLevel) Logger {
+	return common.NewLogger(w, min)
+}
+
 // Options passed on Service creation
 type Options struct {
-	// Silence non-error log outputs
+	// Silence non-error log outputs. Ignored, if Logger is set.
 	Quiet bool
 
+	// Logger to use for all log output. Note that the logger is shared by all
+	// services in the process. Defaults to logging messages of LevelInfo and
+	// above with the standard library's default logger.
+	Logger Logger
+
 	// Allow images with varying explicitness. Defaults to only Safe.
 	Explicitness []Rating
 
+	// Selection of images not matching the captcha tag. SimilarDistractors
+	// prefers images sharing tags, such as hair colour or copyright, with the
+	// matching images, which makes captchas harder to solve by simple
+	// classifiers. Tags defaults to DefaultDistractorTags. Defaults to
+	// RandomDistractors.
+	//
+	// Set Exclude to prevent images with tags equivalent to the captcha tag,
+	// such as ":>" and "smug", from being used as distractors. Set MinTags to
+	// skip sparsely tagged images, that might depict the captcha tag without
+	// being tagged with it.
+	Distractors Distractors
+
+	// Expose Prometheus-compatible metrics on the /metrics path of
+	// Service.Router(). Use Service.ServeMetrics to mount them on a different
+	// router instead.
+	Metrics bool
+
+	// Called on captcha lifecycle and image pool events. The handler is called
+	// synchronously and must not block. Note that captcha storage is shared by
+	// the process and as such the handler receives captcha events of all
+	// services. Call Service.Close to stop receiving events.
+	OnEvent func(Event)
+
+	// Return from NewService immediately and initialize all tag pools in the
+	// background. Until at least 3 tags are ready, NewCaptcha returns
+	// ErrNotReady. Use Service.Ready to wait for the service to become ready.
+	Background bool
+
+	// Do not fetch or thumbnail any images and only serve captchas from the
+	// existing image pool. The pool must be populated by a separate process
+	// sharing the same database and image directory, such as the captchouli
+	// command. Tags with too few images in the pool are skipped. Always
+	// enabled in builds without OpenCV.
+	ServeOnly bool
+
+	// Randomized distortions applied to thumbnails every time they are served
+	// in a captcha. Note that this setting is shared by all services in the
+	// process. Defaults to DefaultDistortion.
+	Distortion *Distortion
+
+	// Size and encoding of thumbnails. Note that this setting is shared by all
+	// services in the process. Defaults to DefaultThumbnailOptions.
+	Thumbnail *ThumbnailOptions
+
+	// Number of face detection classifiers to load. Images are thumbnailed and
+	// tag pools initialized in parallel up to this number. Shared by all
+	// services in the process. Defaults to runtime.NumCPU().
+	// Ignored, if FaceDetector is set.
+	Classifiers int
+
+	// Parameters of the default cascade classifier face detector. Ignored, if
+	// FaceDetector is set.
+	Cascade CascadeOptions
+
+	// Minimum quality of face crops in newly fetched images. Images not
+	// meeting the thresholds are blacklisted. Shared by all services in the
+	// process. Defaults to no thresholds.
+	Quality QualityThresholds
+
+	// Danbooru API credentials, User-Agent, rate limits and HTTP client used
+	// for all API requests and image downloads. Shared by all services in the
+	// process.
+	Danbooru DanbooruOptions
+
+	// Tag rules applied to newly fetched posts in addition to the default
+	// blacklist. Posts not passing the rules are blacklisted. Use
+	// ReevaluateBlacklist to apply newly blacklisted tags to already pooled
+	// images. Shared by all services in the process.
+	Content ContentFilter
+
+	// Number of thumbnails cropped from each fetched image. Shared by all
+	// services in the process. Defaults to a single tight crop of the largest
+	// face.
+	Crops CropOptions
+
+	// Maximum Hamming distance between the 64 bit perceptual hashes of two
+	// images for them to be considered near-duplicates. Near-duplicates of
+	// pooled images are rejected on ingestion and are not shown together in
+	// the same captcha. Zero only matches identical hashes and negative values
+	// disable near-duplicate detection. Shared by all services in the process.
+	// Defaults to DefaultDuplicateDistance.
+	DuplicateDistance *int
+
+	// Custom face detector to use for thumbnailing, such as one created with
+	// NewDNNDetector. The caller retains ownership of the detector and must
+	// close it after closing captchouli. Shared by all services in the
+	// process. Defaults to the embedded anime face cascade classifier.
+	FaceDetector FaceDetector
+
+	// Maximum number of thumbnails distorted concurrently. Shared by all
+	// services in the process. Defaults to runtime.NumCPU().
+	DistortWorkers int
+
+	// Maximum number of queued fetch requests for the service to still be
+	// considered ready by Service.Readiness. Defaults to 128.
+	MaxFetchBacklog int
+
+	// Source of all random decisions, such as the choice of captcha tag,
+	// images, their order and thumbnail distortions. Set a source with a
+	// fixed seed to make captchas reproducible in tests. Image fetching draws
+	// from a separate stream seeded from the source, so background fetches do
+	// not affect generated captchas. Captcha IDs are always generated with a
+	// cryptographically secure source. Shared by all services in the process.
+	// Defaults to a cryptographically secure source.
+	RandomSource rand.Source
+
 	// Tags to source for captcha solutions. One tag is randomly chosen for each
 	// generated captcha. Required to contain at least 3 tags.
 	//
 	// Note that you can only include tags that are discernable from the
 	// character's face, such as who the character is (example: "cirno") or a
 	// facial feature of the character (example: "smug").
+	//
+	// Tags renamed on Danbooru are resolved to their current name, which is
+	// then used for captchas and image pools.
 	Tags []string
 }
 
 // Encapsulates a configured captcha-generation and verification service
 type Service struct {
-	quiet           bool
+	metrics         bool
+	serveOnly       bool
+	maxFetchBacklog int
 	explicitnessStr string
 	explicitness    []Rating
-	tags            appendSlice
+	distractors     Distractors
+
+	// All configured tags and tags with initialized pools
+	allTags []string
+	tags    appendSlice
+
+	// Closed, once enough tags are initialized to generate captchas
+	ready     chan struct{}
+	readyOnce sync.Once
+
+	// Unregisters Options.OnEvent. Nil, if none was set.
+	unregisterEvents func()
 }
 
 // Slice with thread-safe appending
@@ -103,10 +271,12 @@ func (s *appendSlice) Get() []string {
 	return s.inner
 }
 
-func (s *appendSlice) Append(extra string) {
+// Append to slice and return the new length
+func (s *appendSlice) Append(extra string) int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.inner = append(s.inner, extra)
+	return len(s.inner)
 }
 
 // Create new captcha-generation and verification service
@@ -116,31 +286,111 @@ func NewService(opts Options) (s *Service, err error) {
 		return
 	}
 
+	s, err = configure(opts)
+	if err != nil {
+		return
+	}
+	err = s.initPool(opts.Tags, opts.Background)
+	if err != nil {
+		s.Close()
+		return
+	}
+
+	common.LogInfo("service started")
+	return
+}
+
+// Apply the process-wide settings in opts and create a service without
+// initializing any tag pools
+func configure(opts Options) (s *Service, err error) {
+	switch {
+	case opts.Logger != nil:
+		common.SetLogger(opts.Logger)
+	case opts.Quiet:
+		common.SetLogger(common.NewLogger(nil, LevelWarn))
+	default:
+		common.SetLogger(common.NewLogger(nil, LevelInfo))
+	}
+
 	s = &Service{
-		quiet:        opts.Quiet,
-		explicitness: opts.Explicitness,
+		metrics:         opts.Metrics,
+		maxFetchBacklog: opts.MaxFetchBacklog,
+		explicitness:    opts.Explicitness,
+		distractors:     opts.Distractors,
+		allTags:         opts.Tags,
+		ready:           make(chan struct{}),
+		serveOnly:       opts.ServeOnly || !openCVEnabled,
 	}
 	if len(s.explicitness) == 0 {
 		s.explicitness = []Rating{Safe}
 	}
+	if s.distractors.Strategy == SimilarDistractors &&
+		len(s.distractors.Tags) == 0 {
+		s.distractors.Tags = DefaultDistractorTags
+	}
+	s.formatExplicitness() // Cache before concurrent tag initialization
+	if s.maxFetchBacklog <= 0 {
+		s.maxFetchBacklog = defaultMaxFetchBacklog
+	}
 
-	err = initClassifier()
+	err = danbooru.Configure(opts.Danbooru)
 	if err != nil {
 		return
 	}
-	err = s.initPool(opts.Tags)
-	if err != nil {
-		return
+	if !s.serveOnly {
+		err = initDetector(opts.FaceDetector, opts.Cascade, opts.Classifiers)
+		if err != nil {
+			return
+		}
 	}
-
-	if !s.quiet {
-		log.Println("captchouli: service started")
+	setQualityThresholds(opts.Quality)
+	danbooru.SetContentFilter(opts.Content)
+	setCropOptions(opts.Crops)
+	setDuplicateDistance(opts.DuplicateDistance)
+	common.SetRandomSource(opts.RandomSource)
+	backfillOnce.Do(func() {
+		go func() {
+			err := backfillPerceptualHashes()
+			if err != nil {
+				common.LogError("could not compute perceptual hashes",
+					"error", err)
+			}
+		}()
+	})
+	if opts.Distortion != nil {
+		setDistortion(*opts.Distortion)
+	} else {
+		setDistortion(DefaultDistortion)
+	}
+	if opts.Thumbnail != nil {
+		setThumbnailOptions(*opts.Thumbnail)
+	} else {
+		setThumbnailOptions(DefaultThumbnailOptions)
+	}
+	setDistortWorkers(opts.DistortWorkers)
+	if opts.OnEvent != nil {
+		s.unregisterEvents = registerEventHandler(opts.OnEvent)
 	}
 	return
 }
 
-// Initialize pool with enough images, if lacking
-func (s *Service) initPool(tags []string) (err error) {
+// Stop passing events to the Options.OnEvent handler of the service. Does not
+// stop any tag pool initialization or fetches already in progress.
+func (s *Service) Close() {
+	if s.unregisterEvents != nil {
+		s.unregisterEvents()
+	}
+}
+
+// Returns a channel, that is closed once the service has enough initialized
+// tags to generate captchas
+func (s *Service) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Initialize pool with enough images, if lacking.
+// If background = true, all tags are initialized asynchronously.
+func (s *Service) initPool(tags []string, background bool) (err error) {
 	formatErr := func(tag string, err error) error {
 		return Error{
 			Err: fmt.Errorf(
@@ -151,30 +401,113 @@ func (s *Service) initPool(tags []string) (err error) {
 		}
 	}
 
+	if s.serveOnly {
+		return s.initPoolServeOnly(tags)
+	}
+
 	// Init first 3 tags needed for operation first and init the rest
 	// eventually to reduce startup times
-	for _, tag := range tags[:3] {
-		err = s.initTag(tag)
-		if err != nil {
-			return formatErr(tag, err)
+	async := tags
+	if !background {
+		for _, tag := range tags[:minReadyTags] {
+			tag = s.resolveTag(tag)
+			err = s.initTag(tag)
+			if err != nil {
+				return formatErr(tag, err)
+			}
+			s.addTag(tag)
 		}
-		s.tags.Append(tag)
+		async = tags[minReadyTags:]
 	}
-	if len(tags) > 3 {
-		go func() {
-			for _, tag := range tags[3:] {
-				err = s.initTag(tag)
-				if err != nil {
-					log.Print(formatErr(tag, err))
-				} else {
-					s.tags.Append(tag)
+	if len(async) != 0 {
+		// Initialize tags in parallel up to the detector concurrency
+		src := make(chan string, len(async))
+		for _, tag := range async {
+			src <- tag
+		}
+		close(src)
+		workers := detectorConcurrency()
+		if workers > len(async) {
+			workers = len(async)
+		}
+		for i := 0; i < workers; i++ {
+			go func() {
+				for tag := range src {
+					tag = s.resolveTag(tag)
+					err := s.initTag(tag)
+					if err != nil {
+						common.LogError("error initializing image pool",
+							"tag", tag, "error", err)
+					} else {
+						s.addTag(tag)
+					}
 				}
-			}
-		}()
+			}()
+		}
+	}
+	return
+}
+
+// Make all tags with enough images in the existing pool available for captcha
+// generation
+func (s *Service) initPoolServeOnly(tags []string) (err error) {
+	for _, tag := range tags {
+		tag = s.resolveTag(tag)
+		var n int
+		n, err = db.ImageCount(s.filters(tag))
+		if err != nil {
+			return
+		}
+		if n < poolMinSize {
+			common.LogWarn("too few images in pool; skipping tag", "tag", tag,
+				"images", n)
+			continue
+		}
+		s.addTag(tag)
+	}
+	if n := len(s.tags.Get()); n < minReadyTags {
+		return Error{fmt.Errorf(
+			"only %d tags have populated image pools; need at least %d",
+			n, minReadyTags)}
 	}
 	return
 }
 
+// Return the current name of a configured tag, that might have been renamed
+// on the booru. Serve-only services only consult the local alias table.
+func (s *Service) resolveTag(tag string) string {
+	var (
+		resolved string
+		err      error
+	)
+	if s.serveOnly {
+		resolved, _, err = db.ResolveTagAlias(tag)
+	} else {
+		resolved, err = danbooru.ResolveTag(tag)
+	}
+	if err != nil {
+		common.LogWarn("could not resolve tag aliases", "tag", tag,
+			"error", err)
+	}
+	if resolved == "" {
+		return tag
+	}
+	return resolved
+}
+
+// Make an initialized tag available for captcha generation
+func (s *Service) addTag(tag string) {
+	if s.tags.Append(tag) >= minReadyTags {
+		s.readyOnce.Do(func() {
+			close(s.ready)
+		})
+	}
+	emit(Event{
+		Type: TagReady,
+		Tag:  tag,
+	})
+}
+
 func (s *Service) formatExplicitness() string {
 	if s.explicitnessStr != "" {
 		return s.explicitnessStr
@@ -206,24 +539,20 @@ func (s *Service) initTag(tag string) (err error) {
 			return
 		}
 		if count >= poolMinSize {
-			// Terminate open line
 			if fetchCount != 0 {
-				fmt.Print("\n")
+				common.LogInfo("tag initialized", "tag", tag, "images", count,
+					"fetches", fetchCount)
 			}
 			return
 		} else if first {
 			first = false
-			log.Printf(
-				"captchouli: initializing tag=%s explicitness=%s\n",
-				tag,
-				s.formatExplicitness(),
-			)
+			common.LogInfo("initializing tag", "tag", tag,
+				"explicitness", s.formatExplicitness())
 		}
 
-		if !s.quiet {
-			fetchCount++
-			fmt.Printf("captchouli: image fetch: %d\n", fetchCount)
-		}
+		fetchCount++
+		common.LogInfo("image fetch", "tag", tag, "count", fetchCount,
+			"images", count)
 		err = fetch(req)
 		if err != nil {
 			return
@@ -237,6 +566,7 @@ func (s *Service) filters(tag string) db.Filters {
 			Tag: tag,
 		},
 		Explicitness: s.explicitness,
+		Distractors:  s.distractors,
 	}
 }
 
@@ -245,30 +575,60 @@ func (s *Service) filters(tag string) db.Filters {
 // Depending on what type w is, you might want to buffer the output with
 // bufio.NewWriter.
 func (s *Service) NewCaptcha(w io.Writer, colour, background string,
+) (id [64]byte, err error) {
+	return s.newCaptcha(w, colour, background, nil)
+}
+
+// r is the client request, if generated through an HTTP handler
+func (s *Service) newCaptcha(w io.Writer, colour, background string,
+	r *http.Request,
 ) (id [64]byte, err error) {
 	tags := s.tags.Get()
-	tag := tags[common.RandomInt(len(tags))]
-	f := s.filters(tag)
-	n, err := db.ImageCount(f)
-	if err != nil {
+	if len(tags) < minReadyTags {
+		err = ErrNotReady
 		return
 	}
-	if n < 4 {
-		// Not enough to generate captcha. Schedule a fetch and try a different
-		// tag.
-		if !common.IsTest {
+
+	// Try each tag at most once in random order
+	tags = append([]string(nil), tags...)
+	common.CaptchaRand.Shuffle(len(tags), func(i, j int) {
+		tags[i], tags[j] = tags[j], tags[i]
+	})
+	var (
+		tag    string
+		f      db.Filters
+		images [9][16]byte
+	)
+	for _, t := range tags {
+		f = s.filters(t)
+		var n int
+		n, err = db.ImageCount(f)
+		if err != nil {
+			return
+		}
+		if n >= 4 {
+			id, images, err = db.GenerateCaptcha(f)
+			switch err {
+			case nil:
+				tag = t
+			case common.ErrNotEnoughImages:
+				err = nil
+			default:
+				return
+			}
+			if tag != "" {
+				break
+			}
+		}
+
+		// Not enough to generate captcha. Schedule a fetch and try a
+		// different tag.
+		if !common.IsTest && !s.serveOnly {
 			scheduleFetch <- f.FetchRequest
 		}
-		return s.NewCaptcha(w, colour, background)
 	}
-
-	id, images, err := db.GenerateCaptcha(db.Filters{
-		FetchRequest: common.FetchRequest{
-			Tag: tag,
-		},
-		Explicitness: s.explicitness,
-	})
-	if err != nil {
+	if tag == "" {
+		err = ErrNotReady
 		return
 	}
 
@@ -288,9 +648,20 @@ func (s *Service) NewCaptcha(w io.Writer, colour, background string,
 			tagF = strings.Title(tagF)
 		}
 	}
-	templates.WriteCaptcha(w, colour, background, tagF, id, images)
+	thumbs, err := distortThumbnails(images)
+	if err != nil {
+		return
+	}
+	templates.WriteCaptcha(w, colour, background, tagF, id, thumbs)
+	stats.captchasGenerated.Inc(tag)
+	emit(Event{
+		Type:    CaptchaIssued,
+		Tag:     tag,
+		ID:      id,
+		Request: r,
+	})
 
-	if !common.IsTest {
+	if !common.IsTest && !s.serveOnly {
 		scheduleFetch <- f.FetchRequest
 	}
 	return
@@ -299,12 +670,34 @@ func (s *Service) NewCaptcha(w io.Writer, colour, background string,
 // Check a captcha solution for validity.
 // solution: slice of selected image numbers
 func CheckCaptcha(id [64]byte, solution []byte) error {
-	solved, err := db.CheckSolution(id, solution)
+	return checkCaptcha(id, solution, nil)
+}
+
+// r is the client request, if checked through an HTTP handler
+func checkCaptcha(id [64]byte, solution []byte, r *http.Request) error {
+	solved, tag, err := db.CheckSolution(id, solution)
 	if err != nil {
 		return err
-	} else if !solved {
+	}
+
+	e := Event{
+		Tag:     tag,
+		ID:      id,
+		Request: r,
+	}
+	if !solved {
+		if tag == "" {
+			atomic.AddUint64(&stats.captchasUnknown, 1)
+		} else {
+			stats.captchasFailed.Inc(tag)
+		}
+		e.Type = CaptchaFailed
+		emit(e)
 		return ErrInvalidSolution
 	}
+	stats.captchasSolved.Inc(tag)
+	e.Type = CaptchaSolved
+	emit(e)
 	return nil
 }
 
@@ -325,12 +718,34 @@ func (s *Service) Router() *httprouter.Router {
 	) {
 		handleError(w, ServeStatus(w, r))
 	})
+	r.HandlerFunc("GET", "/healthz", func(w http.ResponseWriter,
+		r *http.Request,
+	) {
+		handleError(w, ServeHealth(w, r))
+	})
+	r.HandlerFunc("GET", "/readyz", func(w http.ResponseWriter,
+		r *http.Request,
+	) {
+		handleError(w, s.ServeReady(w, r))
+	})
+	if s.metrics {
+		r.HandlerFunc("GET", "/metrics", func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			handleError(w, s.ServeMetrics(w, r))
+		})
+	}
 	return r
 }
 
 // Generate new captcha and serve its HTML form
 func (s *Service) ServeNewCaptcha(w http.ResponseWriter, r *http.Request,
 ) (err error) {
+	// Check before any headers or gzipped content is written
+	if len(s.tags.Get()) < minReadyTags {
+		return ErrNotReady
+	}
+
 	gw := gzip.NewWriter(w)
 	defer gw.Close()
 
@@ -343,7 +758,8 @@ func (s *Service) ServeNewCaptcha(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return
 	}
-	_, err = s.NewCaptcha(gw, r.Form.Get(ColourKey), r.Form.Get(BackgroundKey))
+	_, err = s.newCaptcha(gw, r.Form.Get(ColourKey), r.Form.Get(BackgroundKey),
+		r)
 	return
 }
 
@@ -359,7 +775,7 @@ func (s *Service) ServeCheckCaptcha(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	err = CheckCaptcha(id, solution)
+	err = checkCaptcha(id, solution, r)
 	switch err {
 	case nil:
 		dst := make([]byte, base64.StdEncoding.EncodedLen(len(id)))
@@ -378,6 +794,9 @@ func handleError(w http.ResponseWriter, err error) {
 		return
 	case ErrInvalidID:
 		code = 400
+	case ErrNotReady:
+		code = 503
+		w.Header().Set("Retry-After", "10")
 	}
 	http.Error(w, err.Error(), code)
 }
@@ -389,10 +808,17 @@ func ServeStatus(w http.ResponseWriter, r *http.Request) (err error) {
 	if err != nil {
 		return
 	}
-	solved, err := db.IsSolved(id)
+	solved, tag, err := db.IsSolved(id)
 	if err != nil {
 		return
 	}
+	emit(Event{
+		Type:    CaptchaConsumed,
+		Tag:     tag,
+		ID:      id,
+		Solved:  solved,
+		Request: r,
+	})
 	w.Write(strconv.AppendBool(nil, solved))
 	return
 }
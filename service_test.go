@@ -1,13 +1,19 @@
 package captchouli
 
 import (
+	"bytes"
 	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
 
 	"github.com/bakape/captchouli/v2/common"
+	"github.com/bakape/captchouli/v2/db"
+	"github.com/bakape/captchouli/v2/test_utils"
 )
 
 func TestCaptcha(t *testing.T) {
@@ -68,3 +74,153 @@ func assertCode(t *testing.T, w *httptest.ResponseRecorder, code int) {
 		t.Fatal(w.Code)
 	}
 }
+
+func TestNotReady(t *testing.T) {
+	s := &Service{
+		explicitness: []Rating{Safe},
+		ready:        make(chan struct{}),
+	}
+
+	_, err := s.NewCaptcha(new(strings.Builder), "", "")
+	if err != ErrNotReady {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, r)
+	assertCode(t, w, 503)
+
+	for _, tag := range [...]string{"a", "b", "c"} {
+		s.addTag(tag)
+	}
+	select {
+	case <-s.Ready():
+	default:
+		t.Fatal("service not ready")
+	}
+}
+
+// Insert n Safe images tagged with tag and "solo" with valid thumbnails into
+// the pool
+func insertServable(t *testing.T, n int, tag string) {
+	t.Helper()
+
+	src := image.NewRGBA(image.Rect(0, 0, 150, 150))
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 150; x++ {
+			src.SetRGBA(x, y, color.RGBA{
+				R: uint8(x),
+				G: uint8(y),
+				B: uint8(x * y),
+				A: 255,
+			})
+		}
+	}
+	var w bytes.Buffer
+	err := png.Encode(&w, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		img, _ := randomImage(t, 1, tag, "solo")
+		img.Rating = Safe
+		err = writeThumbnail(w.Bytes(), img.Crops[0].Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.InsertImage(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServeOnly(t *testing.T) {
+	var tags [4]string
+	for i := range tags {
+		tags[i] = test_utils.RandomTag()
+	}
+	for _, tag := range tags[:3] {
+		insertServable(t, poolMinSize, tag)
+	}
+	// Too few images
+	insertServable(t, poolMinSize-1, tags[3])
+
+	newServeOnly := func(tags ...string) (*Service, error) {
+		return NewService(Options{
+			Tags:      tags,
+			ServeOnly: true,
+			// Skip images inserted by other tests without thumbnails
+			Distractors: Distractors{
+				MinTags: 2,
+			},
+			Danbooru: DanbooruOptions{
+				BaseURL:   booru.URL,
+				RateLimit: 1000,
+			},
+		})
+	}
+
+	_, err := newServeOnly(tags[1:]...)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	s, err := newServeOnly(tags[:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.tags.Get()
+	if len(got) != 3 {
+		t.Fatalf("unexpected tags: %v", got)
+	}
+	for i, tag := range got {
+		if tag != tags[i] {
+			t.Fatalf("unexpected tags: %v", got)
+		}
+	}
+	select {
+	case <-s.Ready():
+	default:
+		t.Fatal("service not ready")
+	}
+
+	var w strings.Builder
+	_, err = s.NewCaptcha(&w, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Len() == 0 {
+		t.Fatal("empty captcha")
+	}
+
+	// Tags populated after startup are not used for captchas and not ready
+	insertServable(t, 1, tags[3])
+	re, err := s.Readiness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.Ready || re.ReadyTags != 3 || re.Tags[3].Ready ||
+		re.Tags[3].Images != poolMinSize {
+		t.Fatalf("unexpected readiness: %+v", re)
+	}
+
+	// Pools depleted by another process
+	_, err = db.BlacklistTagged(tags[:3], "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.NewCaptcha(&w, "", "")
+	if err != ErrNotReady {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	re, err = s.Readiness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.Ready || re.ReadyTags != 0 {
+		t.Fatalf("unexpected readiness: %+v", re)
+	}
+}
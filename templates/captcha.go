@@ -4,24 +4,28 @@ package templates
 
 import (
 	"encoding/base64"
-	"io"
-	"os"
 
-	"github.com/bakape/captchouli/v2/common"
 	"github.com/valyala/quicktemplate"
 )
 
+// Encoded thumbnail image with an optional double-size variant
+type Thumbnail struct {
+	MIME         string
+	Data, Data2x []byte
+}
+
 func streamencodeID(w *quicktemplate.Writer, id [64]byte) {
 	enc := base64.NewEncoder(base64.StdEncoding, w.W())
 	defer enc.Close()
 	enc.Write(id[:])
 }
 
-func streamthumbnail(w *quicktemplate.Writer, id [16]byte, tempBuf []byte) {
-	f, err := os.Open(common.ThumbPath(id))
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	io.CopyBuffer(w.W(), f, tempBuf)
+// Write thumbnail as a data URI
+func streamthumbnail(w *quicktemplate.Writer, mime string, thumb []byte) {
+	w.N().S("data:")
+	w.N().S(mime)
+	w.N().S(";base64,")
+	enc := base64.NewEncoder(base64.StdEncoding, w.W())
+	defer enc.Close()
+	enc.Write(thumb)
 }
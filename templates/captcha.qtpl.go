@@ -21,7 +21,7 @@ var (
 )
 
 //line captcha.qtpl:3
-func StreamCaptcha(qw422016 *qt422016.Writer, colour, background, tag string, id [64]byte, images [9][16]byte) {
+func StreamCaptcha(qw422016 *qt422016.Writer, colour, background, tag string, id [64]byte, images [9]Thumbnail) {
 //line captcha.qtpl:3
 	qw422016.N().S(`<style>.captchouli-checkbox {display: none;}.captchouli-checkbox:checked ~ .captchouli-img {transform: scale(0.8);}.captchouli-img {margin: 2px;-ms-user-select: none;-webkit-user-select: none;-moz-user-select: none;user-select: none;max-width: calc((100% - 12px) / 3);max-height: calc((100% - 12px) / 3);}.captchouli-width {width: 462px;}.captchouli-form {height: auto;}.captchouli-margin {margin: 4px 0;}@media screen and (max-width: 462px) {.captchouli-width {max-width: 100%;}.captchouli-form {position: fixed;z-index: 1000;left: 0;top: 0;}.captchouli-margin {margin: 0;}}@media screen and (max-height: 525px) {.captchouli-form {overflow-y: scroll;position: fixed;z-index: 1000;left: 0;top: 0;max-height: 100%;}.captchouli-margin {margin: 0;}}</style><form method="post" class="captchouli-width captchouli-form" style="background:`)
 //line captcha.qtpl:57
@@ -61,49 +61,62 @@ func StreamCaptcha(qw422016 *qt422016.Writer, colour, background, tag string, id
 //line captcha.qtpl:62
 	qw422016.N().S(`</b></header><div class="captchouli-width">`)
 //line captcha.qtpl:65
-	buf := make([]byte, 4096)
-
-//line captcha.qtpl:66
 	for i, img := range images {
-//line captcha.qtpl:66
+//line captcha.qtpl:65
 		qw422016.N().S(`<label><input type="checkbox" name="captchouli-`)
-//line captcha.qtpl:68
+//line captcha.qtpl:67
 		qw422016.N().D(i)
-//line captcha.qtpl:68
+//line captcha.qtpl:67
 		qw422016.N().S(`" class="captchouli-checkbox"><img class="captchouli-img" draggable="false" src="`)
-//line captcha.qtpl:69
-		streamthumbnail(qw422016, img, buf)
-//line captcha.qtpl:69
-		qw422016.N().S(`"></label>`)
-//line captcha.qtpl:71
+//line captcha.qtpl:68
+		streamthumbnail(qw422016, img.MIME, img.Data)
+//line captcha.qtpl:68
+		qw422016.N().S(`"`)
+//line captcha.qtpl:68
+		if img.Data2x != nil {
+//line captcha.qtpl:68
+			qw422016.N().S(` `)
+//line captcha.qtpl:68
+			qw422016.N().S(`srcset="`)
+//line captcha.qtpl:68
+			streamthumbnail(qw422016, img.MIME, img.Data2x)
+//line captcha.qtpl:68
+			qw422016.N().S(` `)
+//line captcha.qtpl:68
+			qw422016.N().S(`2x"`)
+//line captcha.qtpl:68
+		}
+//line captcha.qtpl:68
+		qw422016.N().S(`></label>`)
+//line captcha.qtpl:70
 	}
-//line captcha.qtpl:71
+//line captcha.qtpl:70
 	qw422016.N().S(`</div><input type="submit" class="captchouli-width captchouli-margin"></form>`)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 }
 
-//line captcha.qtpl:75
-func WriteCaptcha(qq422016 qtio422016.Writer, colour, background, tag string, id [64]byte, images [9][16]byte) {
-//line captcha.qtpl:75
+//line captcha.qtpl:74
+func WriteCaptcha(qq422016 qtio422016.Writer, colour, background, tag string, id [64]byte, images [9]Thumbnail) {
+//line captcha.qtpl:74
 	qw422016 := qt422016.AcquireWriter(qq422016)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 	StreamCaptcha(qw422016, colour, background, tag, id, images)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 	qt422016.ReleaseWriter(qw422016)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 }
 
-//line captcha.qtpl:75
-func Captcha(colour, background, tag string, id [64]byte, images [9][16]byte) string {
-//line captcha.qtpl:75
+//line captcha.qtpl:74
+func Captcha(colour, background, tag string, id [64]byte, images [9]Thumbnail) string {
+//line captcha.qtpl:74
 	qb422016 := qt422016.AcquireByteBuffer()
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 	WriteCaptcha(qb422016, colour, background, tag, id, images)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 	qs422016 := string(qb422016.B)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 	qt422016.ReleaseByteBuffer(qb422016)
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 	return qs422016
-//line captcha.qtpl:75
+//line captcha.qtpl:74
 }
@@ -0,0 +1,136 @@
+package test_utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Fake Danbooru API server for hermetic tests. Serves a single page of
+// generated solo posts for each added tag. All posts link to the same image.
+type FakeDanbooru struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	image   []byte
+	posts   map[string][]fakePost
+	aliases map[string]string
+}
+
+// Subset of the fields of a Danbooru post
+type fakePost struct {
+	MD5     string `json:"md5"`
+	FileURL string `json:"file_url"`
+	Rating  string `json:"rating"`
+	General string `json:"tag_string_general"`
+}
+
+// Relationship between two tags
+type fakeRelation struct {
+	Antecedent string `json:"antecedent_name"`
+	Consequent string `json:"consequent_name"`
+}
+
+// Start a fake Danbooru server serving image as the file of all posts. The
+// caller must close the server after use.
+func NewFakeDanbooru(image []byte) *FakeDanbooru {
+	f := &FakeDanbooru{
+		image:   image,
+		posts:   make(map[string][]fakePost),
+		aliases: make(map[string]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/posts.json", f.servePosts)
+	mux.HandleFunc("/tag_aliases.json", f.serveAliases)
+	mux.HandleFunc("/tag_implications.json", func(w http.ResponseWriter,
+		_ *http.Request,
+	) {
+		writeJSON(w, []fakeRelation{})
+	})
+	mux.HandleFunc("/data/", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(f.image)
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Return a random tag, that is unique to the test run
+func RandomTag() string {
+	var buf [8]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	return "test_" + hex.EncodeToString(buf[:])
+}
+
+// Serve n posts with random MD5 hashes tagged with tag and "solo"
+func (f *FakeDanbooru) AddTag(tag string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		var md5 [16]byte
+		_, err := rand.Read(md5[:])
+		if err != nil {
+			panic(err)
+		}
+		h := hex.EncodeToString(md5[:])
+		f.posts[tag] = append(f.posts[tag], fakePost{
+			MD5:     h,
+			FileURL: f.URL + "/data/" + h + ".jpg",
+			Rating:  "g",
+			General: "1girl solo " + tag,
+		})
+	}
+}
+
+// Alias tag from to tag to. Queries for from return posts tagged with to.
+func (f *FakeDanbooru) AddAlias(from, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aliases[from] = to
+}
+
+func (f *FakeDanbooru) servePosts(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	posts := []fakePost{}
+	if p := r.URL.Query().Get("page"); p == "" || p == "0" || p == "1" {
+		// Only the first tag of a query is matched
+		var tag string
+		if tags := strings.Fields(r.URL.Query().Get("tags")); len(tags) != 0 {
+			tag = tags[0]
+		}
+		if to, ok := f.aliases[tag]; ok {
+			tag = to
+		}
+		if p := f.posts[tag]; p != nil {
+			posts = p
+		}
+	}
+	writeJSON(w, posts)
+}
+
+func (f *FakeDanbooru) serveAliases(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rels := []fakeRelation{}
+	from := r.URL.Query().Get("search[antecedent_name]")
+	if to, ok := f.aliases[from]; ok {
+		rels = append(rels, fakeRelation{from, to})
+	}
+	writeJSON(w, rels)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -1,7 +1,12 @@
+//go:build cgo && !nocv
+// +build cgo,!nocv
+
 extern "C" {
 #include "thumbnail.h"
 }
 #include "distort.hh"
+#include "util.hh"
+#include <algorithm>
 #include <cstring>
 #include <functional>
 #include <iostream>
@@ -10,58 +15,101 @@ extern "C" {
 
 #if CV_MAJOR_VERSION > 3
     #define CV_INTER_LINEAR cv::INTER_LINEAR
+    #define CV_INTER_AREA cv::INTER_AREA
     #define CV_IMWRITE_JPEG_QUALITY cv::IMWRITE_JPEG_QUALITY
+    #define CV_IMWRITE_WEBP_QUALITY cv::IMWRITE_WEBP_QUALITY
 #endif
 
-// Size of thumbnail dimension. thumbnail is always a square.
-static const int thumb_dim = 150;
-
-static const char* thumbnail(
-    cv::CascadeClassifier* c, const char* path, Buffer* thumb)
+// Encode Mat as image of passed extension to a malloced buffer
+static const char* encode(const std::string& ext, const cv::Mat& img,
+    const std::vector<int>& params, Buffer* dst)
 {
-    static const char no_faces[] = "no faces detected";
+    std::vector<unsigned char> out;
+    if (!cv::imencode(ext, img, out, params)) {
+        return "could not encode result";
+    }
+    const auto s = out.size();
+    dst->data = memcpy(malloc(s), out.data(), s);
+    dst->size = s;
+    return 0;
+}
 
-    const cv::Mat colour = cv::imread(path, cv::IMREAD_COLOR);
-    if (colour.empty()) {
-        return no_faces;
+// Encode Mat in the configured output format and dimensions
+static const char* encode_output(
+    const cv::Mat& img, const EncodeOptions& opts, int dim, Buffer* dst)
+{
+    cv::Mat resized;
+    if (img.cols != dim || img.rows != dim) {
+        cv::resize(img, resized, cv::Size(dim, dim), 0, 0,
+            img.cols > dim ? CV_INTER_AREA : CV_INTER_LINEAR);
+    } else {
+        resized = img;
     }
 
-    // Always keep the resulting Mat in dst and swap before a new operation
-    cv::Mat src, dst;
-    auto swap = [&]() { cv::swap(src, dst); };
+    switch (opts.format) {
+    case FORMAT_PNG:
+        return encode(".png", resized, {}, dst);
+    case FORMAT_WEBP:
+        return encode(
+            ".webp", resized, { CV_IMWRITE_WEBP_QUALITY, opts.quality }, dst);
+    default:
+        return encode(
+            ".jpg", resized, { CV_IMWRITE_JPEG_QUALITY, opts.quality }, dst);
+    }
+}
 
-    // Initial assignment does not need swap
-    cv::cvtColor(colour, dst, cv::COLOR_BGR2GRAY);
-    swap();
-    cv::equalizeHist(src, dst);
+// Compute quality metrics of a face crop at source resolution
+static void measure(const cv::Mat& img, const cv::Rect& face,
+    const Face& detected, Quality* q)
+{
+    cv::Mat grey, lap;
+    cv::cvtColor(cv::Mat(img, face), grey, cv::COLOR_BGR2GRAY);
+    cv::Scalar mean, stddev;
+    cv::meanStdDev(grey, mean, stddev);
+    q->contrast = stddev[0];
+    cv::Laplacian(grey, lap, CV_64F);
+    cv::meanStdDev(lap, mean, stddev);
+    q->sharpness = stddev[0] * stddev[0];
+
+    q->face_size = face.width;
+    q->relative_size
+        = double(face.area()) / (double(img.cols) * double(img.rows));
+    q->aspect = detected.width && detected.height
+        ? double(std::min(detected.width, detected.height))
+            / std::max(detected.width, detected.height)
+        : 0;
+}
 
-    std::vector<cv::Rect> faces;
-    c->detectMultiScale(dst, faces, 1.1, 5, 0, cv::Size(50, 50));
-    if (!faces.size()) {
-        return no_faces;
+static const char* thumbnail(const cv::Mat& colour, const Face& detected,
+    double zoom, int thumb_dim, Buffer* thumb, Quality* quality)
+{
+    // Not all detectors produce square matches. Extend the shorter side and
+    // apply zoom around the match center, while staying in bounds.
+    cv::Rect face(detected.x, detected.y, detected.width, detected.height);
+    const int longest = std::max(face.width, face.height);
+    const int side = std::min(int(longest * std::max(zoom, 0.1)),
+        std::min(colour.cols, colour.rows));
+    if (face.width != side || face.height != side) {
+        const int x = face.x + face.width / 2 - side / 2;
+        const int y = face.y + face.height / 2 - side / 2;
+        face = cv::Rect(std::max(0, std::min(x, colour.cols - side)),
+            std::max(0, std::min(y, colour.rows - side)), side, side);
     }
 
-    cv::Rect face;
-    if (faces.size() == 1) {
-        face = faces.front();
-    } else {
-        // Find biggest match
-        uint64_t max_size = 0;
-        for (auto& f : faces) {
-            uint64_t s = (uint64_t)f.width + (uint64_t)f.height;
-            if (s > max_size) {
-                face = f;
-                max_size = s;
-            }
-        }
+    face &= cv::Rect(0, 0, colour.cols, colour.rows);
+    if (face.empty()) {
+        return "face out of image bounds";
     }
+    measure(colour, face, detected, quality);
 
-    // Increase matched size, if image bellow 150x150.
+    cv::Mat dst;
+
+    // Increase matched size, if image bellow thumbnail dimensions.
     // face should always be a square.
     if (face.width < thumb_dim && face.height == face.width) {
         // Perform bounds checks and find the largest equal increase size in all
         // directions
-        int diff = (150 - face.width) / 2;
+        int diff = (thumb_dim - face.width) / 2;
         if (face.x - diff < 0) {
             diff = face.x;
         }
@@ -82,18 +130,32 @@ static const char* thumbnail(
 
     cv::resize(cv::Mat(colour, face), dst, cv::Size(thumb_dim, thumb_dim), 0, 0,
         CV_INTER_LINEAR);
-    swap();
-    cpli_distort_mat(src, dst);
 
-    std::vector<unsigned char> out;
-    static const std::vector<int> params = { CV_IMWRITE_JPEG_QUALITY, 85 };
-    if (!cv::imencode(".jpg", dst, out, params)) {
-        return "could not encode result";
+    // Store the crop losslessly. Distortion is applied on each use.
+    return encode(".png", dst, {}, thumb);
+}
+
+static const char* distort(const void* data, size_t size,
+    const DistortOptions& opts, const EncodeOptions& enc, Buffer* out,
+    Buffer* out_2x)
+{
+    const std::vector<unsigned char> buf(
+        static_cast<const unsigned char*>(data),
+        static_cast<const unsigned char*>(data) + size);
+    cv::Mat src = cv::imdecode(buf, cv::IMREAD_COLOR);
+    if (src.empty()) {
+        return "could not decode thumbnail";
     }
-    const auto s = out.size();
-    thumb->data = memcpy(malloc(s), out.data(), s);
-    thumb->size = s;
-    return 0;
+
+    // Distort at the stored resolution once and downscale for each variant
+    cv::Mat dst;
+    cpli_distort_mat(src, dst, opts);
+
+    auto err = encode_output(dst, enc, enc.dim, out);
+    if (err || !enc.hidpi) {
+        return err;
+    }
+    return encode_output(dst, enc, enc.dim * 2, out_2x);
 }
 
 static char* malloc_string(const char* s)
@@ -101,7 +163,7 @@ static char* malloc_string(const char* s)
     return strcpy((char*)malloc(strlen(s) + 1), s);
 }
 
-static char* catch_errors(std::function<const char*()> fn)
+char* cpli_catch_errors(std::function<const char*()> fn)
 {
     try {
         auto err = fn();
@@ -114,26 +176,38 @@ static char* catch_errors(std::function<const char*()> fn)
     }
 }
 
-extern "C" void* cpli_load_classifier(const char* path)
+extern "C" void* cpli_load_image(const char* path)
 {
-    auto c = new cv::CascadeClassifier();
-    if (!c->load(path)) {
-        delete c;
+    try {
+        auto img = new cv::Mat(cv::imread(path, cv::IMREAD_COLOR));
+        if (img->empty()) {
+            delete img;
+            return nullptr;
+        }
+        return img;
+    } catch (const std::exception&) {
         return nullptr;
     }
-    return c;
 }
 
-extern "C" void cpli_unload_classifier(void* c)
+extern "C" void cpli_unload_image(void* img)
 {
-    delete static_cast<cv::CascadeClassifier*>(c);
+    delete static_cast<cv::Mat*>(img);
 }
 
-extern "C" char* cpli_thumbnail(
-    void* classifier, const char* path, Buffer* thumb)
+extern "C" char* cpli_thumbnail(const void* img, const Face* face,
+    double zoom, int dim, Buffer* thumb, Quality* quality)
 {
-    return catch_errors([=]() {
-        return thumbnail(
-            static_cast<cv::CascadeClassifier*>(classifier), path, thumb);
+    return cpli_catch_errors([=]() {
+        return thumbnail(*static_cast<const cv::Mat*>(img), *face, zoom, dim,
+            thumb, quality);
     });
 }
+
+extern "C" char* cpli_distort(const void* data, size_t size,
+    const DistortOptions* opts, const EncodeOptions* enc, Buffer* out,
+    Buffer* out_2x)
+{
+    return cpli_catch_errors(
+        [=]() { return distort(data, size, *opts, *enc, out, out_2x); });
+}
@@ -1,3 +1,6 @@
+//go:build cgo && !nocv
+// +build cgo,!nocv
+
 package captchouli
 
 // #cgo pkg-config: opencv4
@@ -8,69 +11,190 @@ package captchouli
 import "C"
 import (
 	"bytes"
-	"compress/gzip"
 	"errors"
-	"io"
-	"io/ioutil"
-	"os"
-	"sync"
 	"unsafe"
-)
 
-var (
-	classifier   unsafe.Pointer
-	classifierMu sync.Mutex
+	"github.com/bakape/captchouli/v2/templates"
 )
 
-func initClassifier() (err error) {
-	classifierMu.Lock()
-	defer classifierMu.Unlock()
+// Face detection and thumbnail generation are available
+const openCVEnabled = true
 
-	if classifier != nil {
-		return
+func convertDistortion(d Distortion) C.DistortOptions {
+	conv := func(f DistortionFilter) C.FilterOptions {
+		clamp := func(f float64) C.double {
+			switch {
+			case f < 0:
+				return 0
+			case f > 1:
+				return 1
+			default:
+				return C.double(f)
+			}
+		}
+
+		return C.FilterOptions{
+			probability: clamp(f.Probability),
+			strength:    clamp(f.Strength),
+		}
 	}
 
-	// XXX: Not having the cascade file embedded into the binary would prevent
-	// go-getablity but the OpenCV CascadeClassifier requires a file path.
-	r, err := gzip.NewReader(bytes.NewReader(cascade_animeface))
-	if err != nil {
-		return
+	return C.DistortOptions{
+		flip:        conv(d.Flip),
+		blur:        conv(d.Blur),
+		rotate:      conv(d.Rotate),
+		crop:        conv(d.Crop),
+		hue:         conv(d.Hue),
+		noise:       conv(d.Noise),
+		jpeg:        conv(d.JPEG),
+		perspective: conv(d.Perspective),
+		occlude:     conv(d.Occlude),
 	}
-	defer r.Close()
+}
 
-	tmp, err := ioutil.TempFile("", "*.xml")
+// Generate undistorted thumbnails of the largest faces in passed image,
+// measure their quality and compute their perceptual hashes. The crops
+// produced are controlled by CropOptions. Identical crops are only returned
+// once. Safe to call concurrently.
+func thumbnails(path string) (crops []crop, err error) {
+	dim := C.int(getThumbnailOptions().storedSize())
+	opts := getCropOptions()
+
+	// Hold the read lock to prevent unloading, while the detector is in use
+	detectorMu.RLock()
+	defer detectorMu.RUnlock()
+	if detector == nil {
+		err = Error{errors.New("face detector not loaded")}
+		return
+	}
+	faces, err := detector.Detect(path)
 	if err != nil {
 		return
 	}
-	defer os.Remove(tmp.Name())
-	defer tmp.Close()
+	if len(faces) == 0 {
+		err = ErrNoFace
+		return
+	}
+	sortFaces(faces)
+	if len(faces) > opts.MaxFaces {
+		faces = faces[:opts.MaxFaces]
+	}
 
-	_, err = io.Copy(tmp, r)
-	if err != nil {
+	// Decode once for all crops
+	pathC := C.CString(path)
+	defer C.free(unsafe.Pointer(pathC))
+	img := C.cpli_load_image(pathC)
+	if img == nil {
+		err = Error{errors.New("could not read image")}
 		return
 	}
+	defer C.cpli_unload_image(img)
+
+	for _, f := range faces {
+		face := C.Face{
+			x:          C.int(f.Min.X),
+			y:          C.int(f.Min.Y),
+			width:      C.int(f.Dx()),
+			height:     C.int(f.Dy()),
+			confidence: C.double(f.Confidence),
+		}
+	zooms:
+		for _, zoom := range opts.Zoom {
+			var (
+				out C.Buffer
+				q   C.Quality
+				c   crop
+			)
+			errC := C.cpli_thumbnail(img, &face, C.double(zoom), dim, &out, &q)
+			c.thumb, err = convertResult(errC, out)
+			if err != nil {
+				return
+			}
+
+			// Zoom levels can produce the same crop, when clamped to the
+			// image bounds
+			for _, prev := range crops {
+				if bytes.Equal(prev.thumb, c.thumb) {
+					continue zooms
+				}
+			}
 
-	name := C.CString(tmp.Name())
-	defer C.free(unsafe.Pointer(name))
-	c := C.cpli_load_classifier(name)
-	if c == nil {
-		return Error{errors.New("unable to load classifier")}
+			c.phash, err = perceptualHash(c.thumb)
+			if err != nil {
+				return
+			}
+			c.quality = Quality{
+				FaceSize:     int(q.face_size),
+				RelativeSize: float64(q.relative_size),
+				Sharpness:    float64(q.sharpness),
+				Contrast:     float64(q.contrast),
+				Confidence:   f.Confidence,
+				Aspect:       float64(q.aspect),
+			}
+			crops = append(crops, c)
+		}
 	}
-	classifier = c
 	return
 }
 
-// Generate a thumbnail of passed image.
-// NOTE: the generated thumbnail is not deterministic.
-func thumbnail(path string) (thumb []byte, err error) {
-	classifierMu.Lock()
-	defer classifierMu.Unlock()
+// Apply randomized distortion to a stored thumbnail and encode it in the
+// configured output format. Runs on a bounded pool of workers. The
+// distortions are determined by seed.
+func distort(thumb []byte, seed int64) (t templates.Thumbnail, err error) {
+	if len(thumb) == 0 {
+		err = Error{errors.New("empty thumbnail")}
+		return
+	}
 
-	var out C.Buffer
-	pathC := C.CString(path)
-	defer C.free(unsafe.Pointer(pathC))
+	sem := distortWorkers.Load().(chan struct{})
+	sem <- struct{}{}
+	defer func() {
+		<-sem
+	}()
+
+	distortionMu.RLock()
+	opts := convertDistortion(distortion)
+	o := output
+	distortionMu.RUnlock()
+	opts.seed = C.uint64_t(seed)
+
+	enc := C.EncodeOptions{
+		dim:     C.int(o.Size),
+		quality: C.int(o.Quality),
+		hidpi:   C.bool(o.HiDPI),
+	}
+	switch o.Format {
+	case PNG:
+		enc.format = C.FORMAT_PNG
+	case WebP:
+		enc.format = C.FORMAT_WEBP
+	default:
+		enc.format = C.FORMAT_JPEG
+	}
+
+	var out, out2x C.Buffer
+	errC := C.cpli_distort(unsafe.Pointer(&thumb[0]), C.size_t(len(thumb)),
+		&opts, &enc, &out, &out2x)
+	t.Data, err = convertResult(errC, out)
+	if err != nil {
+		if out2x.data != nil {
+			C.free(out2x.data)
+		}
+		return
+	}
+	if o.HiDPI {
+		t.Data2x, err = convertResult(nil, out2x)
+		if err != nil {
+			return
+		}
+	}
+	t.MIME = o.Format.MIME()
+	return
+}
 
-	errC := C.cpli_thumbnail(classifier, pathC, &out)
+// Convert the result of a C function returning an error string and writing to
+// a buffer and free any C memory
+func convertResult(errC *C.char, out C.Buffer) (buf []byte, err error) {
 	defer func() {
 		if errC != nil {
 			C.free(unsafe.Pointer(errC))
@@ -89,6 +213,6 @@ func thumbnail(path string) (thumb []byte, err error) {
 		return
 	}
 
-	thumb = C.GoBytes(out.data, C.int(out.size))
+	buf = C.GoBytes(out.data, C.int(out.size))
 	return
 }
@@ -1,12 +1,61 @@
 #pragma once
+#include "detect.h"
+#include <stdbool.h>
 #include <stddef.h>
+#include <stdint.h>
 
 typedef struct {
     void* data;
     size_t size;
 } Buffer;
 
-char* cpli_thumbnail(void* classifier, const char* path, Buffer* thumb);
+// Probability and strength of a single distortion filter. Both are in the
+// [0;1] range.
+typedef struct {
+    double probability;
+    double strength;
+} FilterOptions;
+
+// Randomized distortions applied to generated thumbnails
+typedef struct {
+    FilterOptions flip, blur, rotate, crop, hue, noise, jpeg, perspective,
+        occlude;
+    uint64_t seed; // Seed of the random number generator
+} DistortOptions;
+
+// Output image formats
+enum { FORMAT_JPEG, FORMAT_PNG, FORMAT_WEBP };
+
+// Encoding of distorted thumbnails
+typedef struct {
+    int dim; // Dimension of output. Thumbnails are always square.
+    int format;
+    int quality; // [0;100]. Ignored for PNG.
+    bool hidpi; // Also output a variant with double dimensions
+} EncodeOptions;
+
+// Quality metrics of a face crop
+typedef struct {
+    int face_size; // Side of the square crop in source image pixels
+    double relative_size; // Crop area divided by image area
+    double sharpness; // Variance of the Laplacian of the crop
+    double contrast; // Standard deviation of crop luminance
+    double aspect; // Shorter to longer side ratio of the detected face
+} Quality;
+
+// Decode the image at path for cropping. Returns NULL, if the image could not
+// be read.
+void* cpli_load_image(const char* path);
+void cpli_unload_image(void* img);
+
+// Crop the detected face from an image loaded with cpli_load_image and write
+// it as an undistorted PNG of dim x dim size to thumb. zoom scales the crop
+// around the face center. Quality metrics of the crop are written to quality.
+char* cpli_thumbnail(const void* img, const Face* face, double zoom, int dim,
+    Buffer* thumb, Quality* quality);
+
+// Apply randomized distortion to an encoded thumbnail and write the result
+// to out. If enc->hidpi is set, a double-size variant is written to out_2x.
+char* cpli_distort(const void* data, size_t size, const DistortOptions* opts,
+    const EncodeOptions* enc, Buffer* out, Buffer* out_2x);
 
-void* cpli_load_classifier(const char* path);
-void cpli_unload_classifier(void* c);
@@ -2,6 +2,7 @@ package captchouli
 
 import (
 	"fmt"
+	"image"
 	"path/filepath"
 	"testing"
 
@@ -26,12 +27,217 @@ func TestThumbnailing(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			thumb, err := thumbnail(p)
+			crops, err := thumbnails(p)
 			if err != nil {
 				t.Fatal(err)
 			}
-			test_utils.WriteSample(t, fmt.Sprintf("sample_%s_thumb.jpg", c.ext),
+			if len(crops) != 1 {
+				t.Fatalf("unexpected crop count: %d", len(crops))
+			}
+			thumb, q := crops[0].thumb, crops[0].quality
+			if q.FaceSize <= 0 || q.RelativeSize <= 0 || q.RelativeSize > 1 ||
+				q.Sharpness <= 0 || q.Contrast <= 0 || q.Aspect <= 0 {
+				t.Fatalf("invalid quality metrics: %+v", q)
+			}
+			test_utils.WriteSample(t, fmt.Sprintf("sample_%s_thumb.png", c.ext),
 				thumb)
+
+			distorted, err := distort(thumb, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test_utils.WriteSample(t,
+				fmt.Sprintf("sample_%s_distorted.jpg", c.ext), distorted.Data)
 		})
 	}
 }
+
+func TestFullDistortion(t *testing.T) {
+	newService(t)
+	full := DistortionFilter{1, 1}
+	setDistortion(Distortion{
+		Flip:        full,
+		Blur:        full,
+		Rotate:      full,
+		Crop:        full,
+		Hue:         full,
+		Noise:       full,
+		JPEG:        full,
+		Perspective: full,
+		Occlude:     full,
+	})
+	defer setDistortion(DefaultDistortion)
+
+	p, err := filepath.Abs(filepath.Join("testdata", "sample.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb := firstCrop(t, p)
+	distorted, err := distort(thumb, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_utils.WriteSample(t, "sample_full_distortion.jpg", distorted.Data)
+}
+
+func TestThumbnailOptions(t *testing.T) {
+	newService(t)
+
+	p, err := filepath.Abs(filepath.Join("testdata", "sample.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb := firstCrop(t, p)
+
+	setThumbnailOptions(ThumbnailOptions{
+		Size:   200,
+		HiDPI:  true,
+		Format: PNG,
+	})
+	defer setThumbnailOptions(DefaultThumbnailOptions)
+
+	distorted, err := distort(thumb, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if distorted.MIME != "image/png" {
+		t.Fatal(distorted.MIME)
+	}
+	if len(distorted.Data2x) == 0 {
+		t.Fatal("no 2x variant")
+	}
+	test_utils.WriteSample(t, "sample_200.png", distorted.Data)
+	test_utils.WriteSample(t, "sample_200_2x.png", distorted.Data2x)
+}
+
+func TestConcurrentThumbnailing(t *testing.T) {
+	newService(t)
+
+	p, err := filepath.Abs(filepath.Join("testdata", "sample.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := detectorConcurrency() * 2
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			_, err := thumbnails(p)
+			errs <- err
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type fixedDetector []Face
+
+func (d fixedDetector) Detect(string) ([]Face, error) {
+	return d, nil
+}
+
+func TestCustomDetector(t *testing.T) {
+	newService(t)
+	defer func() {
+		closeDetector()
+		if err := initDetector(nil, CascadeOptions{}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	p, err := filepath.Abs(filepath.Join("testdata", "sample.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = initDetector(fixedDetector{}, CascadeOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = thumbnails(p)
+	if err != ErrNoFace {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = initDetector(fixedDetector{
+		{Rectangle: image.Rect(0, 0, 10, 10), Confidence: 1},
+		{Rectangle: image.Rect(20, 20, 120, 100), Confidence: 0.5},
+	}, CascadeOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb := firstCrop(t, p)
+	test_utils.WriteSample(t, "sample_custom_detector.png", thumb)
+}
+
+func TestMultipleCrops(t *testing.T) {
+	newService(t)
+	defer func() {
+		setCropOptions(CropOptions{})
+		closeDetector()
+		if err := initDetector(nil, CascadeOptions{}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	p, err := filepath.Abs(filepath.Join("testdata", "sample.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = initDetector(fixedDetector{
+		{Rectangle: image.Rect(0, 0, 60, 60)},
+		{Rectangle: image.Rect(100, 100, 200, 200)},
+		{Rectangle: image.Rect(0, 100, 10, 110)},
+	}, CascadeOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setCropOptions(CropOptions{
+		MaxFaces: 2,
+		Zoom:     []float64{1, 1.5},
+	})
+
+	crops, err := thumbnails(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crops) != 4 {
+		t.Fatalf("unexpected crop count: %d", len(crops))
+	}
+	if crops[0].quality.FaceSize != 100 || crops[1].quality.FaceSize != 150 {
+		t.Fatalf("largest face not cropped first: %+v", crops)
+	}
+	for i, c := range crops {
+		test_utils.WriteSample(t, fmt.Sprintf("sample_crop_%d.png", i),
+			c.thumb)
+	}
+}
+
+func TestSortFaces(t *testing.T) {
+	faces := []Face{
+		{Rectangle: image.Rect(0, 0, 10, 10)},
+		{Rectangle: image.Rect(5, 5, 50, 40)},
+		{Rectangle: image.Rect(0, 0, 20, 20)},
+	}
+	sortFaces(faces)
+	for i, size := range [...]int{45 * 35, 20 * 20, 10 * 10} {
+		if s := faces[i].Size(); s.X*s.Y != size {
+			t.Fatalf("face %d: %v", i, faces[i])
+		}
+	}
+}
+
+// Return the first crop of the image at path
+func firstCrop(t *testing.T, path string) []byte {
+	t.Helper()
+
+	crops, err := thumbnails(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crops[0].thumb
+}
@@ -0,0 +1,6 @@
+#pragma once
+#include <functional>
+
+// Run fn and convert any returned error string or thrown exception to a
+// malloced string. Returns nullptr on success.
+char* cpli_catch_errors(std::function<const char*()> fn);